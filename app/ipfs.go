@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime"
@@ -58,16 +59,43 @@ func start(client serverpb.ClientClient, ctx context.Context) {
 			peers(cmd, client, ctx)
 		case "reference":
 			reference(cmd, client, ctx)
+		case "pin":
+			pin(cmd, client, ctx)
+		case "gc":
+			gc(cmd, client, ctx)
+		case "storage":
+			storage(cmd, client, ctx)
+		case "replicas":
+			replicas(cmd, client, ctx)
+		case "providers":
+			providers(cmd, client, ctx)
+		case "export":
+			export(cmd, client, ctx)
+		case "import":
+			importArchive(cmd, client, ctx)
 		case "help":
 			fmt.Println("\n 🚀  List of options: \n")
-			fmt.Println("	get <document_id>			   Fetch a document")
+			fmt.Println("	get <document_id>[/path]		   Fetch a document")
+			fmt.Println("	get -o <dest> <document_id>[/path]	   Save a document or directory to disk")
 			fmt.Println("	add <path/to/file>		  	   Add a document to this node")
+			fmt.Println("	add -cdc <path/to/file>		  	   Add a document split into content defined blocks")
 			fmt.Println("	add -r <path/to/dir>		  	   Add a directory to this node")
 			fmt.Println("	add -c <documents>		  	   Create a parent to a list of existing documents")
+			fmt.Println("	add -e <path/to/file/or/dir>		   Add an encrypted file or directory")
 			fmt.Println("	peers list				   List this node's peers")
 			fmt.Println("	peers add <node_id>	  		   Add a peer to this node")
 			fmt.Println("	reference get <reference_id>		   Fetch what that this reference points to")
 			fmt.Println("	reference add <record> <path/to/priv_key>  Add or update a reference")
+			fmt.Println("	pin add <document_id>			   Pin a document and everything it links to")
+			fmt.Println("	pin add -d <document_id>		   Pin only this document")
+			fmt.Println("	pin rm <document_id>			   Unpin a document")
+			fmt.Println("	pin ls					   List pinned documents")
+			fmt.Println("	gc					   Remove documents that aren't pinned")
+			fmt.Println("	storage					   Show the storage used by this node")
+			fmt.Println("	replicas <document_id>			   List the peers storing a replicated document")
+			fmt.Println("	providers <document_id>			   List the nodes storing a document")
+			fmt.Println("	export <document_id> <path/to/archive>	   Export a document and everything it links to")
+			fmt.Println("	import <path/to/archive>		   Import and pin the documents in an archive")
 			fmt.Println("	quit					   Exit the program\n")
 		case "quit":
 			fmt.Println("Exiting program... Goodbye. 🌙")
@@ -79,51 +107,140 @@ func start(client serverpb.ClientClient, ctx context.Context) {
 }
 
 func get(cmd []string, client serverpb.ClientClient, ctx context.Context) {
-	if len(cmd) != 2 {
-		fmt.Println("Incorrect number of arguments. Please specify a file ID.")
+	if len(cmd) == 4 && cmd[1] == "-o" {
+		// Write the document to the local filesystem
+		if err := getToPath(cmd[3], cmd[2], ctx, client); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Saved to " + cmd[2])
+		}
+	} else if len(cmd) > 1 && cmd[1] == "-o" {
+		fmt.Println("Please specify the destination path and a file ID or path.")
+	} else if len(cmd) != 2 {
+		fmt.Println("Incorrect number of arguments. Please specify a file ID or path.")
 	} else {
 		args := &serverpb.GetRequest{
 			DocumentId: cmd[1],
 		}
-		resp, err := client.Get(ctx, args)
+		stream, err := client.GetStream(ctx, args)
 		if err != nil {
 			fmt.Println(err)
-		} else {
-			if resp.GetDocument().GetContentType() == "directory" {
-				fmt.Println("Child document IDs:")
-				for _, v := range resp.GetDocument().GetChildren() {
-					fmt.Println(v)
-				}
-			} else {
-				fmt.Printf("%s\n", resp.Document.GetData())
+			return
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if resp.GetDocument().GetContentType() == "directory" {
+			fmt.Println("Document ID: " + resp.GetDocumentId())
+			fmt.Println("Child documents:")
+			for name, v := range resp.GetDocument().GetChildren() {
+				fmt.Println(name + "	" + v)
 			}
+			return
+		}
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				fmt.Println(err)
+				return
+			}
+			printProgress(resp.GetProgress())
+			os.Stdout.Write(resp.GetData())
 		}
+		fmt.Println()
+	}
+}
+
+// getToPath downloads a document to dest. Directories are recreated
+// recursively, the inverse of addTree.
+func getToPath(id string, dest string, ctx context.Context, client serverpb.ClientClient) error {
+	// Cancel the stream when returning so directories, which only read the
+	// first message, don't leave it open.
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.GetStream(streamCtx, &serverpb.GetRequest{
+		DocumentId: id,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if resp.GetDocument().GetContentType() == "directory" {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		for name, child := range resp.GetDocument().GetChildren() {
+			if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+				return fmt.Errorf("invalid file name %q in directory %s", name, resp.GetDocumentId())
+			}
+			if err := getToPath(child, filepath.Join(dest, name), ctx, client); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		printProgress(resp.GetProgress())
+		if _, err := file.Write(resp.GetData()); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// printProgress prints the progress of a download from peers to stderr so it
+// doesn't mix with the document written to stdout.
+func printProgress(p *serverpb.DownloadProgress) {
+	if p == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\rDownloaded %d/%d blocks (%.1f KB/s)", p.GetBlocksDone(), p.GetBlocksTotal(), p.GetBytesPerSecond()/1024)
+	if p.GetBlocksDone() == p.GetBlocksTotal() {
+		fmt.Fprintln(os.Stderr)
 	}
 }
 
 func add(cmd []string, client serverpb.ClientClient, ctx context.Context) {
 	if len(cmd) < 2 {
 		fmt.Println("Incorrect number of arguments. Please specify the path to the file or directory you wish to add.")
-	} else if len(cmd) == 2 && cmd[1] != "-r" && cmd[1] != "-c" {
+	} else if len(cmd) == 2 && cmd[1] != "-r" && cmd[1] != "-c" && cmd[1] != "-cdc" && cmd[1] != "-e" {
 		// Adding a single file
-		data, err := ioutil.ReadFile(cmd[1])
+		hash, err := addFile(cmd[1], ctx, client, serverpb.FIXED, false, true)
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			contentType := getContentType(cmd[1])
-			args := &serverpb.AddRequest{
-				Document: &serverpb.Document{
-					Data:        data,
-					ContentType: contentType,
-				},
-			}
-			resp, err := client.Add(ctx, args)
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Document ID: " + resp.GetDocumentId())
-			}
+			fmt.Println("Document ID: " + hash)
 		}
+	} else if cmd[1] == "-cdc" && len(cmd) == 3 {
+		// Adding a single file split into content defined blocks
+		hash, err := addFile(cmd[2], ctx, client, serverpb.FASTCDC, false, true)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Document ID: " + hash)
+		}
+	} else if cmd[1] == "-cdc" && len(cmd) != 3 {
+		fmt.Println("Please specify the path to the file you wish to add.")
 	} else if cmd[1] == "-r" && len(cmd) == 3 {
 		// Recursively add files (adding a directory)
 		dir, err := os.Stat(cmd[2])
@@ -135,7 +252,7 @@ func add(cmd []string, client serverpb.ClientClient, ctx context.Context) {
 			fmt.Println("Not a directory.")
 			return
 		}
-		hash, err := addDir(cmd[2], ctx, client)
+		hash, err := addTree(cmd[2], ctx, client, false)
 		if err != nil {
 			fmt.Println(err)
 		} else {
@@ -169,6 +286,16 @@ func add(cmd []string, client serverpb.ClientClient, ctx context.Context) {
 		}
 	} else if cmd[1] == "-c" && len(cmd) != 3 {
 		fmt.Println("Please specify the list of documents you wish to create a parent for, in the format of 'name1:document1_id,name2:document2_id'")
+	} else if cmd[1] == "-e" && len(cmd) == 3 {
+		// Encrypting a file or directory
+		capability, err := addTree(cmd[2], ctx, client, true)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Capability: " + capability)
+		}
+	} else if cmd[1] == "-e" && len(cmd) != 3 {
+		fmt.Println("Please specify the path to the file or directory you wish to encrypt.")
 	} else {
 		fmt.Println("Invalid command.")
 	}
@@ -251,37 +378,278 @@ func reference(cmd []string, client serverpb.ClientClient, ctx context.Context)
 	}
 }
 
+func pin(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) < 2 {
+		fmt.Println("Incorrect number of arguments.")
+	} else if cmd[1] == "add" && len(cmd) == 3 {
+		args := &serverpb.PinRequest{
+			DocumentId: cmd[2],
+			Recursive:  true,
+		}
+		if _, err := client.Pin(ctx, args); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Pinned " + cmd[2])
+		}
+	} else if cmd[1] == "add" && len(cmd) == 4 && cmd[2] == "-d" {
+		args := &serverpb.PinRequest{
+			DocumentId: cmd[3],
+		}
+		if _, err := client.Pin(ctx, args); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Pinned " + cmd[3])
+		}
+	} else if cmd[1] == "add" {
+		fmt.Println("Please specify a document ID.")
+	} else if cmd[1] == "rm" && len(cmd) == 3 {
+		args := &serverpb.UnpinRequest{
+			DocumentId: cmd[2],
+		}
+		if _, err := client.Unpin(ctx, args); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Unpinned " + cmd[2])
+		}
+	} else if cmd[1] == "rm" {
+		fmt.Println("Please specify a document ID.")
+	} else if cmd[1] == "ls" {
+		resp, err := client.ListPins(ctx, &serverpb.ListPinsRequest{})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, p := range resp.GetPins() {
+			if p.GetRecursive() {
+				fmt.Println(p.GetDocumentId() + " recursive")
+			} else {
+				fmt.Println(p.GetDocumentId() + " direct")
+			}
+		}
+	} else {
+		fmt.Println("Invalid command.")
+	}
+}
+
+func gc(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	resp, err := client.GarbageCollect(ctx, &serverpb.GarbageCollectRequest{})
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Removed %d documents\n", resp.GetRemoved())
+	}
+}
+
+func storage(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	resp, err := client.StorageUsage(ctx, &serverpb.StorageUsageRequest{})
+	if err != nil {
+		fmt.Println(err)
+	} else if resp.GetMax() > 0 {
+		fmt.Printf("%d documents using %d of %d bytes\n", resp.GetDocuments(), resp.GetUsed(), resp.GetMax())
+	} else {
+		fmt.Printf("%d documents using %d bytes\n", resp.GetDocuments(), resp.GetUsed())
+	}
+}
+
+func replicas(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) != 2 {
+		fmt.Println("Incorrect number of arguments. Please specify a document ID.")
+		return
+	}
+	resp, err := client.Replicas(ctx, &serverpb.ReplicasRequest{
+		DocumentId: cmd[1],
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rep := resp.GetReplication()
+	fmt.Printf("Replicated to %d of %d peers\n", len(rep.GetHolders()), rep.GetFactor())
+	for _, holder := range rep.GetHolders() {
+		fmt.Println(holder)
+	}
+}
+
+func providers(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) != 2 {
+		fmt.Println("Incorrect number of arguments. Please specify a document ID.")
+		return
+	}
+	resp, err := client.FindProviders(ctx, &serverpb.FindProvidersRequest{
+		DocumentId: cmd[1],
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(resp.GetProviders()) == 0 {
+		fmt.Println("No providers found.")
+	}
+	for _, meta := range resp.GetProviders() {
+		fmt.Println(meta.GetId() + "	" + strings.Join(meta.GetAddrs(), ", "))
+	}
+}
+
+func export(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) != 3 {
+		fmt.Println("Incorrect number of arguments. Please specify a document ID and the path to write the archive to.")
+		return
+	}
+	stream, err := client.Export(ctx, &serverpb.ExportRequest{
+		DocumentIds: []string{cmd[1]},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	file, err := os.Create(cmd[2])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer file.Close()
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if _, err := file.Write(resp.GetData()); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	fmt.Println("Exported to " + cmd[2])
+}
+
+func importArchive(cmd []string, client serverpb.ClientClient, ctx context.Context) {
+	if len(cmd) != 2 {
+		fmt.Println("Incorrect number of arguments. Please specify the path to the archive.")
+		return
+	}
+	file, err := os.Open(cmd[1])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer file.Close()
+
+	stream, err := client.Import(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&serverpb.ImportRequest{Data: buf[:n]}); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Imported %d documents\n", resp.GetDocuments())
+	for _, root := range resp.GetRoots() {
+		fmt.Println("Document ID: " + root)
+	}
+}
+
 func getContentType(fname string) string {
 	return mime.TypeByExtension(filepath.Ext(fname))
 }
 
-func addDir(root string, ctx context.Context, client serverpb.ClientClient) (string, error) {
-	file, err := os.Open(root)
+// streamChunkSize is the amount of data sent per message when streaming a file
+// to the node.
+const streamChunkSize = 64 * 1024
+
+// addFile streams a file to the node and returns its document ID. The file is
+// pinned if pin is set.
+func addFile(path string, ctx context.Context, client serverpb.ClientClient, chunker serverpb.Chunker, encrypt, pin bool) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
-	info, err := file.Stat()
+	defer file.Close()
+
+	stream, err := client.AddStream(ctx)
 	if err != nil {
 		return "", err
 	}
-	if !info.IsDir() {
-		data, err := ioutil.ReadAll(file)
-		if err != nil {
-			return "", err
+	req := &serverpb.AddStreamRequest{
+		ContentType: getContentType(path),
+		Chunker:     chunker,
+		Encrypt:     encrypt,
+		NoPin:       !pin,
+	}
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			req.Data = buf[:n]
+			if err := stream.Send(req); err != nil {
+				return "", err
+			}
+			req = &serverpb.AddStreamRequest{}
 		}
-		contentType := getContentType(root)
-		args := &serverpb.AddRequest{
-			Document: &serverpb.Document{
-				Data:        data,
-				ContentType: contentType,
-			},
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
 		}
-		resp, err := client.Add(ctx, args)
-		if err != nil {
+	}
+	if req.ContentType != "" || req.Chunker != serverpb.FIXED || req.Encrypt || req.NoPin {
+		// Empty file; still send the content type, chunker, encrypt and
+		// no_pin.
+		if err := stream.Send(req); err != nil {
 			return "", err
 		}
-		return resp.GetDocumentId(), nil
 	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", err
+	}
+	if encrypt {
+		return resp.GetCapability(), nil
+	}
+	return resp.GetDocumentId(), nil
+}
+
+// addTree adds a file or directory and returns the ID, or the capability if
+// encrypt is set, of its root. Only the root is pinned; the node keeps the
+// documents below it until the root links to them.
+func addTree(root string, ctx context.Context, client serverpb.ClientClient, encrypt bool) (string, error) {
+	return addDir(root, ctx, client, encrypt, true)
+}
+
+// addDir adds a file or directory, pinning it if pin is set.
+func addDir(root string, ctx context.Context, client serverpb.ClientClient, encrypt, pin bool) (string, error) {
+	file, err := os.Open(root)
+	if err != nil {
+		return "", err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		file.Close()
+		return addFile(root, ctx, client, serverpb.FIXED, encrypt, pin)
+	}
+	defer file.Close()
 
 	files, err := file.Readdirnames(0)
 	if err != nil {
@@ -292,7 +660,7 @@ func addDir(root string, ctx context.Context, client serverpb.ClientClient) (str
 		Children:    make(map[string]string),
 	}
 	for _, fname := range files {
-		hash, err := addDir(filepath.Join(root, fname), ctx, client)
+		hash, err := addDir(filepath.Join(root, fname), ctx, client, encrypt, false)
 		if err != nil {
 			return "", err
 		}
@@ -300,10 +668,15 @@ func addDir(root string, ctx context.Context, client serverpb.ClientClient) (str
 	}
 	args := &serverpb.AddRequest{
 		Document: document,
+		Encrypt:  encrypt,
+		NoPin:    !pin,
 	}
 	resp, err := client.Add(ctx, args)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+	if encrypt {
+		return resp.GetCapability(), nil
 	}
 	return resp.GetDocumentId(), nil
 }
@@ -1,6 +1,14 @@
 package integration
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
 	"testing"
@@ -18,16 +26,7 @@ func TestCluster(t *testing.T) {
 	ts := NewTestCluster(t, nodes)
 	defer ts.Close()
 
-	for i, node := range ts.Nodes {
-		util.SucceedsSoon(t, func() error {
-			got := node.NumConnections()
-			want := nodes - 1
-			if got != want {
-				return errors.Errorf("%d. expected %d connections; got %d", i, want, got)
-			}
-			return nil
-		})
-	}
+	ts.WaitConnected()
 }
 
 func TestClusterMaxPeers(t *testing.T) {
@@ -73,3 +72,223 @@ func TestBootstrapAddNode(t *testing.T) {
 		})
 	}
 }
+
+func TestGetFromPeer(t *testing.T) {
+	const nodes = 3
+	ts := NewTestCluster(t, nodes)
+	defer ts.Close()
+
+	ts.WaitConnected()
+
+	ctx := context.Background()
+	doc := &serverpb.Document{
+		Data:        []byte("hello world"),
+		ContentType: "text/plain",
+	}
+	addResp, err := ts.Nodes[0].Add(ctx, &serverpb.AddRequest{Document: doc})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, node := range ts.Nodes[1:] {
+		resp, err := node.Get(ctx, &serverpb.GetRequest{DocumentId: addResp.DocumentId})
+		if err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if !resp.Document.Equal(doc) {
+			t.Fatalf("%d. got %+v; want %+v", i, resp.Document, doc)
+		}
+	}
+
+	if _, err := ts.Nodes[1].Get(ctx, &serverpb.GetRequest{DocumentId: "missing"}); err == nil {
+		t.Fatal("expected error fetching missing document")
+	}
+
+	// Chunked files are reassembled from blocks fetched from the network.
+	large := &serverpb.Document{
+		Data: bytes.Repeat([]byte("0123456789"), 100000),
+	}
+	addResp, err = ts.Nodes[0].Add(ctx, &serverpb.AddRequest{Document: large})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Nodes[1].Get(ctx, &serverpb.GetRequest{DocumentId: addResp.DocumentId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.Document.Data, large.Data) {
+		t.Fatal("reassembled data doesn't match")
+	}
+}
+
+func TestStream(t *testing.T) {
+	const nodes = 2
+	ts := NewTestCluster(t, nodes)
+	defer ts.Close()
+
+	ts.WaitConnected()
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789"), 1000000)
+
+	add, err := ts.Client(0).AddStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := add.Send(&serverpb.AddStreamRequest{ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += 64 * 1024 {
+		end := i + 64*1024
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := add.Send(&serverpb.AddStreamRequest{Data: data[i:end]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addResp, err := add.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get, err := ts.Client(1).GetStream(ctx, &serverpb.GetRequest{DocumentId: addResp.DocumentId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := get.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Document.ContentType != "text/plain" || meta.Document.Length != int64(len(data)) {
+		t.Fatalf("unexpected document metadata %+v", meta.Document)
+	}
+	var got []byte
+	for {
+		resp, err := get.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp.Data...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes; got %d", len(data), len(got))
+	}
+}
+
+func TestFindProviders(t *testing.T) {
+	const nodes = 3
+	ts := NewTestCluster(t, nodes)
+	defer ts.Close()
+
+	ts.WaitConnected()
+
+	ctx := context.Background()
+	addResp, err := ts.Nodes[0].Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: []byte("provided")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ts.Nodes[0].NodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.SucceedsSoon(t, func() error {
+		resp, err := ts.Nodes[2].FindProviders(ctx, &serverpb.FindProvidersRequest{
+			DocumentId: addResp.DocumentId,
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Providers) != 1 || resp.Providers[0].Id != meta.Id {
+			return errors.Errorf("expected provider %s; got %+v", meta.Id, resp.Providers)
+		}
+		return nil
+	})
+}
+
+func TestDHT(t *testing.T) {
+	const nodes = 4
+	// A single peer per node so lookups have to go through the DHT.
+	ts := NewTestCluster(t, nodes, func(c *serverpb.NodeConfig) {
+		c.Routing = "dht"
+		c.MaxPeers = 1
+	})
+	defer ts.Close()
+
+	ctx := context.Background()
+	want := []byte("found through the dht")
+	addResp, err := ts.Nodes[nodes-1].Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: want},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the root of a chunked file is announced; its blocks are fetched
+	// from the providers of the root.
+	big := bytes.Repeat([]byte("chunked through the dht\n"), 1<<16)
+	bigResp, err := ts.Nodes[nodes-1].Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: big},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refResp, err := ts.Nodes[nodes-1].AddReference(ctx, &serverpb.AddReferenceRequest{
+		PrivKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		Record:  "document:" + addResp.DocumentId,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	util.SucceedsSoon(t, func() error {
+		resp, err := ts.Nodes[1].Get(ctx, &serverpb.GetRequest{
+			DocumentId: addResp.DocumentId,
+		})
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(resp.Document.Data, want) {
+			return errors.Errorf("expected %q; got %q", want, resp.Document.Data)
+		}
+		return nil
+	})
+
+	util.SucceedsSoon(t, func() error {
+		resp, err := ts.Nodes[0].Get(ctx, &serverpb.GetRequest{
+			DocumentId: bigResp.DocumentId,
+		})
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(resp.Document.Data, big) {
+			return errors.Errorf("expected %d bytes; got %d", len(big), len(resp.Document.Data))
+		}
+		return nil
+	})
+
+	util.SucceedsSoon(t, func() error {
+		resp, err := ts.Nodes[0].GetReference(ctx, &serverpb.GetReferenceRequest{
+			ReferenceId: refResp.ReferenceId,
+		})
+		if err != nil {
+			return err
+		}
+		if resp.Reference == nil || resp.Reference.Value != "document:"+addResp.DocumentId {
+			return errors.Errorf("expected reference to %s; got %+v", addResp.DocumentId, resp.Reference)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,66 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+)
+
+func TestParallelDownload(t *testing.T) {
+	const nodes = 3
+	ts := NewTestCluster(t, nodes)
+	defer ts.Close()
+
+	ts.WaitConnected()
+
+	// The same file added to two nodes has the same blocks so the third node
+	// can download them from both.
+	data := make([]byte, 2*1024*1024+1)
+	rand.New(rand.NewSource(1)).Read(data)
+	ctx := context.Background()
+	var id string
+	for _, node := range ts.Nodes[:2] {
+		resp, err := node.Add(ctx, &serverpb.AddRequest{
+			Document: &serverpb.Document{Data: data},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id = resp.DocumentId
+	}
+
+	stream, err := ts.Client(2).GetStream(ctx, &serverpb.GetRequest{DocumentId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	var last *serverpb.DownloadProgress
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Progress != nil {
+			last = resp.Progress
+		}
+		got = append(got, resp.Data...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %d bytes; got %d", len(data), len(got))
+	}
+	if last == nil {
+		t.Fatal("expected download progress")
+	}
+	if last.BlocksTotal < 2 || last.BlocksDone != last.BlocksTotal {
+		t.Fatalf("expected every block to be downloaded; got %+v", last)
+	}
+	if last.Bytes == 0 || last.BytesPerSecond <= 0 {
+		t.Fatalf("expected download throughput; got %+v", last)
+	}
+}
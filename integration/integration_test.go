@@ -1,10 +1,14 @@
 package integration
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
@@ -12,6 +16,8 @@ import (
 
 	"github.com/fatih/color"
 	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func init() {
@@ -23,6 +29,7 @@ type cluster struct {
 	t     *testing.T
 	Nodes []*server.Server
 	Dirs  []string
+	conns []*grpc.ClientConn
 }
 
 func NewTestCluster(t *testing.T, n int, opts ...func(*serverpb.NodeConfig)) *cluster {
@@ -93,7 +100,47 @@ func (c *cluster) AddNode(opts ...func(*serverpb.NodeConfig)) *server.Server {
 	return s
 }
 
+// WaitConnected waits until every node is connected to every other node.
+func (c *cluster) WaitConnected() {
+	for i, node := range c.Nodes {
+		util.SucceedsSoon(c.t, func() error {
+			got := node.NumConnections()
+			want := len(c.Nodes) - 1
+			if got != want {
+				return errors.Errorf("%d. expected %d connections; got %d", i, want, got)
+			}
+			return nil
+		})
+	}
+}
+
+// Client returns a client connected to the node with the specified index.
+func (c *cluster) Client(i int) serverpb.ClientClient {
+	meta, err := c.Nodes[i].NodeMeta()
+	if err != nil {
+		c.t.Fatalf("%+v", err)
+	}
+	creds := credentials.NewTLS(&tls.Config{
+		Rand:               rand.Reader,
+		InsecureSkipVerify: true,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, meta.Addrs[0], grpc.WithTransportCredentials(creds), grpc.WithBlock())
+	if err != nil {
+		c.t.Fatalf("%+v", err)
+	}
+	c.conns = append(c.conns, conn)
+	return serverpb.NewClientClient(conn)
+}
+
 func (c *cluster) Close() {
+	for _, conn := range c.conns {
+		if err := conn.Close(); err != nil {
+			c.t.Errorf("%+v", err)
+		}
+	}
+
 	for _, s := range c.Nodes {
 		if err := s.Close(); err != nil {
 			c.t.Errorf("%+v", err)
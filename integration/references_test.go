@@ -0,0 +1,103 @@
+package integration
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+
+	"github.com/pkg/errors"
+)
+
+func TestReferenceDissemination(t *testing.T) {
+	const nodes = 3
+	ts := NewTestCluster(t, nodes)
+	defer ts.Close()
+
+	ts.WaitConnected()
+
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	publish := func(record string) string {
+		resp, err := ts.Nodes[0].AddReference(ctx, &serverpb.AddReferenceRequest{
+			PrivKey: privKey,
+			Record:  record,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.ReferenceId
+	}
+	expect := func(i int, id, value string) {
+		util.SucceedsSoon(t, func() error {
+			resp, err := ts.Nodes[i].GetReference(ctx, &serverpb.GetReferenceRequest{
+				ReferenceId: id,
+			})
+			if err != nil {
+				return err
+			}
+			if resp.Reference == nil || resp.Reference.Value != value {
+				return errors.Errorf("%d. expected %q; got %+v", i, value, resp.Reference)
+			}
+			return nil
+		})
+	}
+
+	id := publish("document:v1")
+	for i := range ts.Nodes {
+		expect(i, id, "document:v1")
+	}
+	v1, err := ts.Nodes[0].GetReference(ctx, &serverpb.GetReferenceRequest{
+		ReferenceId: id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Updates replace the version every node already has.
+	publish("document:v2")
+	for i := range ts.Nodes {
+		expect(i, id, "document:v2")
+	}
+
+	// Nodes that join later look the reference up from their peers, even if
+	// they have an older version.
+	node := ts.AddNode()
+	if _, err := node.PublishReference(ctx, &serverpb.PublishReferenceRequest{
+		Reference: v1.Reference,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	util.SucceedsSoon(t, func() error {
+		meta, err := node.NodeMeta()
+		if err != nil {
+			return err
+		}
+		if len(meta.Addrs) == 0 {
+			return errors.Errorf("no address")
+		}
+		return nil
+	})
+	first, err := ts.Nodes[0].NodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.AddNode(first); err != nil {
+		t.Fatal(err)
+	}
+	expect(nodes, id, "document:v2")
+}
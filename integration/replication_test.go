@@ -0,0 +1,125 @@
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+
+	"github.com/pkg/errors"
+)
+
+// pinned returns whether a node has a recursive pin on a document.
+func pinned(node *server.Server, id string) (bool, error) {
+	resp, err := node.ListPins(context.Background(), &serverpb.ListPinsRequest{})
+	if err != nil {
+		return false, err
+	}
+	for _, pin := range resp.Pins {
+		if pin.DocumentId == id && pin.Recursive {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestReplication(t *testing.T) {
+	const nodes = 4
+	ts := NewTestCluster(t, nodes)
+	defer ts.Close()
+
+	ts.WaitConnected()
+
+	ctx := context.Background()
+	addResp, err := ts.Nodes[0].Add(ctx, &serverpb.AddRequest{
+		Document:          &serverpb.Document{Data: []byte("replicate me")},
+		ReplicationFactor: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := addResp.DocumentId
+
+	holders := func() ([]string, error) {
+		resp, err := ts.Nodes[0].Replicas(ctx, &serverpb.ReplicasRequest{DocumentId: id})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Replication.Holders) != 2 {
+			return nil, errors.Errorf("expected 2 holders; got %v", resp.Replication.Holders)
+		}
+		return resp.Replication.Holders, nil
+	}
+	var initial []string
+	util.SucceedsSoon(t, func() error {
+		initial, err = holders()
+		return err
+	})
+
+	byID := map[string]int{}
+	for i, node := range ts.Nodes {
+		meta, err := node.NodeMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID[meta.Id] = i
+	}
+	for _, holder := range initial {
+		ok, err := pinned(ts.Nodes[byID[holder]], id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("holder %s didn't pin %s", holder, id)
+		}
+	}
+
+	// Stop one of the holders. The document is replicated to the remaining
+	// node once the heartbeat fails.
+	gone := byID[initial[0]]
+	if err := ts.Nodes[gone].Close(); err != nil {
+		t.Fatal(err)
+	}
+	ts.Nodes = append(ts.Nodes[:gone], ts.Nodes[gone+1:]...)
+
+	var current []string
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		current, err = holders()
+		if err == nil && current[0] != initial[0] && current[1] != initial[0] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("document wasn't re-replicated: %+v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Unpinning the document stops replicating it and releases the replicas.
+	if _, err := ts.Nodes[0].Unpin(ctx, &serverpb.UnpinRequest{DocumentId: id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Nodes[0].Replicas(ctx, &serverpb.ReplicasRequest{DocumentId: id}); err == nil {
+		t.Fatal("expected replication record to be removed")
+	}
+	byID = map[string]int{}
+	for i, node := range ts.Nodes {
+		meta, err := node.NodeMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID[meta.Id] = i
+	}
+	for _, holder := range current {
+		ok, err := pinned(ts.Nodes[byID[holder]], id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatalf("holder %s didn't release %s", holder, id)
+		}
+	}
+}
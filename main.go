@@ -1,13 +1,27 @@
 package main
 
 import (
+	"flag"
 	"log"
 
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/server"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 )
 
+var (
+	path              = flag.String("path", "tmp/node1", "directory to store the node's data in")
+	addr              = flag.String("addr", ":0", "address to listen on for gRPC connections")
+	httpAddr          = flag.String("http_addr", "", "address to serve the HTTP gateway on; disabled if empty")
+	maxPeers          = flag.Int("max_peers", 10, "maximum number of peers to connect to")
+	maxStorage        = flag.Int64("max_storage", 0, "maximum number of bytes of documents to store; 0 means unlimited")
+	hashFunction      = flag.String("hash_function", "", `hash function used for new document IDs: "sha2-256" (default) or "sha2-512"`)
+	compression       = flag.String("compression", "", `compression of stored documents: "none" (default) or "snappy"`)
+	replicationFactor = flag.Int("replication_factor", 0, "number of peers added documents are replicated to; 0 disables replication")
+	routing           = flag.String("routing", "", `how documents are found: "bloom" (default) or "dht"`)
+)
+
 func main() {
+	flag.Parse()
 	if err := run(); err != nil {
 		log.Fatal(err)
 	}
@@ -15,11 +29,17 @@ func main() {
 
 func run() error {
 	s, err := server.New(serverpb.NodeConfig{
-		Path:     "tmp/node1",
-		MaxPeers: 10,
+		Path:              *path,
+		MaxPeers:          int32(*maxPeers),
+		MaxStorage:        *maxStorage,
+		HashFunction:      *hashFunction,
+		HttpAddr:          *httpAddr,
+		Compression:       *compression,
+		ReplicationFactor: int32(*replicationFactor),
+		Routing:           *routing,
 	})
 	if err != nil {
 		return err
 	}
-	return s.Listen(":0")
+	return s.Listen(*addr)
 }
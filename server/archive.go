@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	archiveVersion = 1
+
+	// archiveChunkSize is the size of the archive chunks sent by Export.
+	archiveChunkSize = 64 * 1024
+
+	// maxArchiveRecord is the largest header or record accepted on import.
+	maxArchiveRecord = 64 << 20
+)
+
+// writeRecord writes a varint length prefixed record.
+func writeRecord(w io.Writer, parts ...[]byte) error {
+	var length int
+	for _, part := range parts {
+		length += len(part)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	if _, err := w.Write(buf[:binary.PutUvarint(buf, uint64(length))]); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecord reads a varint length prefixed record. It returns io.EOF if there
+// are no more records.
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxArchiveRecord {
+		return nil, errors.Errorf("archive record too large: %d bytes", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "truncated archive record")
+	}
+	return buf, nil
+}
+
+// exportArchive writes the documents with the specified IDs and everything
+// linked from them to w, fetching missing documents from the network.
+func (s *Server) exportArchive(ctx context.Context, w io.Writer, roots []string) error {
+	header := serverpb.ArchiveHeader{
+		Version: archiveVersion,
+		Roots:   roots,
+	}
+	body, err := header.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(w, body); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	var export func(id string) error
+	export = func(id string) error {
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+
+		body, err := s.getDocumentBody(ctx, id)
+		if err != nil {
+			return err
+		}
+		idBuf := make([]byte, binary.MaxVarintLen64)
+		idBuf = append(idBuf[:binary.PutUvarint(idBuf, uint64(len(id)))], id...)
+		if err := writeRecord(w, idBuf, body); err != nil {
+			return err
+		}
+
+		var doc serverpb.Document
+		if err := doc.Unmarshal(body); err != nil {
+			return err
+		}
+		for _, link := range documentLinks(doc) {
+			if err := export(link); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, id := range roots {
+		if err := export(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importArchive stores every document in an archive after checking that it
+// hashes to its ID, holding them with a until they are pinned. It returns the
+// roots listed in the header and the number of documents read.
+func (s *Server) importArchive(r io.Reader, a *adder) ([]string, int64, error) {
+	br := bufio.NewReader(r)
+	body, err := readRecord(br)
+	if err == io.EOF {
+		return nil, 0, errors.New("empty archive")
+	} else if err != nil {
+		return nil, 0, err
+	}
+	var header serverpb.ArchiveHeader
+	if err := header.Unmarshal(body); err != nil {
+		return nil, 0, errors.Wrap(err, "invalid archive header")
+	}
+	if header.Version != archiveVersion {
+		return nil, 0, errors.Errorf("unsupported archive version %d", header.Version)
+	}
+
+	var documents int64
+	for {
+		record, err := readRecord(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		length, n := binary.Uvarint(record)
+		if n <= 0 || length > uint64(len(record)-n) {
+			return nil, 0, errors.Errorf("invalid archive record %d", documents)
+		}
+		id := string(record[n : n+int(length)])
+		body := record[n+int(length):]
+		if err := verifyID(id, body); err != nil {
+			return nil, 0, err
+		}
+		if _, err := a.hold(func() (string, error) {
+			return id, s.putDocument(id, body)
+		}); err != nil {
+			return nil, 0, err
+		}
+		documents++
+	}
+	return header.Roots, documents, nil
+}
+
+// Export streams an archive of the specified documents and everything linked
+// from them.
+func (s *Server) Export(in *serverpb.ExportRequest, stream serverpb.Client_ExportServer) error {
+	if len(in.DocumentIds) == 0 {
+		return errors.New("no documents to export")
+	}
+	w := bufio.NewWriterSize(streamWriter{
+		send: func(data []byte) error {
+			return stream.Send(&serverpb.ExportResponse{Data: data})
+		},
+		max: archiveChunkSize,
+	}, archiveChunkSize)
+	if err := s.exportArchive(stream.Context(), w, in.DocumentIds); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Import reads an archive sent by the client and recursively pins its roots,
+// replicating them like added documents. The imported documents are kept from garbage collection until the roots are
+// pinned, without gcMu being held while reading the archive.
+func (s *Server) Import(stream serverpb.Client_ImportServer) error {
+	a := &adder{s: s}
+	defer a.release()
+	roots, documents, err := s.importArchive(&streamReader{
+		recv: func() ([]byte, error) {
+			req, err := stream.Recv()
+			if err != nil {
+				return nil, err
+			}
+			return req.Data, nil
+		},
+	}, a)
+	if err != nil {
+		return err
+	}
+	for _, id := range roots {
+		// Fails if the archive is missing any documents that can't be
+		// fetched from the network.
+		if err := s.pinFetched(stream.Context(), id, true); err != nil {
+			return errors.Wrapf(err, "root %s", id)
+		}
+		if err := s.replicateImported(id); err != nil {
+			return err
+		}
+	}
+	return stream.SendAndClose(&serverpb.ImportResponse{
+		Roots:     roots,
+		Documents: documents,
+	})
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	src, stopSrc := newTestServer(t)
+	defer stopSrc()
+	dst, stopDst := newTestServer(t)
+	defer stopDst()
+
+	ctx := context.Background()
+	data := make([]byte, 2*blockSize+100)
+	rand.New(rand.NewSource(0)).Read(data)
+	file, err := src.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := src.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			ContentType: "directory",
+			Children:    map[string]string{"a": file.DocumentId, "b": file.DocumentId},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.exportArchive(ctx, &buf, []string{dir.DocumentId}); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	a := &adder{s: dst}
+	defer a.release()
+
+	// Corrupt the last byte of the last block.
+	corrupt := append([]byte{}, archive...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, _, err := dst.importArchive(bytes.NewReader(corrupt), a); err == nil {
+		t.Fatal("expected error importing corrupt archive")
+	}
+	if _, _, err := dst.importArchive(bytes.NewReader(archive[:len(archive)-1]), a); err == nil {
+		t.Fatal("expected error importing truncated archive")
+	}
+
+	roots, documents, err := dst.importArchive(bytes.NewReader(archive), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0] != dir.DocumentId {
+		t.Fatalf("unexpected roots %v", roots)
+	}
+	// The directory, the root of the file and its three blocks.
+	if documents != 5 {
+		t.Fatalf("expected 5 documents; got %d", documents)
+	}
+	// The documents are kept until the roots are pinned.
+	if removed, err := dst.garbageCollect(); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Fatalf("expected imported documents to be kept; got %d removed", removed)
+	}
+
+	got, err := dst.Get(ctx, &serverpb.GetRequest{DocumentId: dir.DocumentId + "/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Document.Data, data) {
+		t.Fatal("imported data doesn't match")
+	}
+}
@@ -1,48 +1,186 @@
 package server
 
 import (
-"github.com/spaolacci/murmur3"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+
+	"github.com/pkg/errors"
+	"github.com/spaolacci/murmur3"
 )
 
+// BloomFilter is a bit-packed bloom filter. Bit i is stored in bit i%64 of
+// word i/64.
 type BloomFilter struct {
-  bit_array []bool
-  k           uint
-  m           uint
+	bitArray []uint64
+	k        uint
+	m        uint
 }
 
-func NewBF(size, num_hash_funcs uint) *BloomFilter {
-  bloomFilter := BloomFilter{
-    bit_array: make([]bool, size),
-    k: num_hash_funcs,
-    m: size,
-  }
+func NewBF(size, numHashFuncs uint) *BloomFilter {
+	if size == 0 {
+		// Positions are taken modulo the size.
+		size = 1
+	}
+	bloomFilter := BloomFilter{
+		bitArray: make([]uint64, (size+63)/64),
+		k:        numHashFuncs,
+		m:        size,
+	}
+
+	return &bloomFilter
+}
 
-  return &bloomFilter
+// BloomFilterParams returns the number of bits and hash functions needed to
+// store n elements with the target false positive rate p, which must be
+// between 0 and 1 exclusive.
+func BloomFilterParams(n uint, p float64) (size, numHashFuncs uint, err error) {
+	if !(p > 0 && p < 1) {
+		return 0, 0, errors.Errorf("false positive rate must be between 0 and 1; got %v", p)
+	}
+	if n == 0 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	if m < 1 {
+		m = 1
+	}
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return uint(m), uint(k), nil
+}
+
+// NewBFWithEstimates returns a filter sized to hold n elements with the
+// target false positive rate p.
+func NewBFWithEstimates(n uint, p float64) (*BloomFilter, error) {
+	size, numHashFuncs, err := BloomFilterParams(n, p)
+	if err != nil {
+		return nil, err
+	}
+	return NewBF(size, numHashFuncs), nil
 }
 
 func (bloomFilter *BloomFilter) Add(item []byte) {
-  for i := 0; i < int(bloomFilter.k); i++ {
-    hash := bloomFilter.getHashValue(item, i)
-    pos := uint(hash) % bloomFilter.m
-    bloomFilter.bit_array[uint(pos)] = true
-  }
+	for i := 0; i < int(bloomFilter.k); i++ {
+		pos := hashPosition(item, i, bloomFilter.m)
+		bloomFilter.bitArray[pos/64] |= 1 << (pos % 64)
+	}
 }
 
 func (bloomFilter *BloomFilter) Check(item []byte) (exists bool) {
-  for i:=0; i < int(bloomFilter.k); i++ {
-    hash := bloomFilter.getHashValue(item, i)
-    pos := uint(hash) % bloomFilter.m
-    if !bloomFilter.bit_array[uint(pos)] {
-      return false
-    }
-  }
-  return true
-}
-
-func (bloomFilter *BloomFilter) getHashValue(item []byte, i int) uint64  {
-  hash_func := murmur3.New64WithSeed(uint32(i))
-  hash_func.Write(item)
-  res := hash_func.Sum64()
-
-  return res
-}
\ No newline at end of file
+	for i := 0; i < int(bloomFilter.k); i++ {
+		pos := hashPosition(item, i, bloomFilter.m)
+		if bloomFilter.bitArray[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (bloomFilter *BloomFilter) compatible(other *BloomFilter) error {
+	if bloomFilter.m != other.m || bloomFilter.k != other.k {
+		return errors.Errorf("bloom filter mismatch: m=%d k=%d; got m=%d k=%d", bloomFilter.m, bloomFilter.k, other.m, other.k)
+	}
+	return nil
+}
+
+// Union sets every bit that is set in other. Both filters must have the same
+// size and number of hash functions.
+func (bloomFilter *BloomFilter) Union(other *BloomFilter) error {
+	if err := bloomFilter.compatible(other); err != nil {
+		return err
+	}
+	for i, word := range other.bitArray {
+		bloomFilter.bitArray[i] |= word
+	}
+	return nil
+}
+
+// Intersect clears every bit that isn't set in other. Both filters must have
+// the same size and number of hash functions.
+func (bloomFilter *BloomFilter) Intersect(other *BloomFilter) error {
+	if err := bloomFilter.compatible(other); err != nil {
+		return err
+	}
+	for i, word := range other.bitArray {
+		bloomFilter.bitArray[i] &= word
+	}
+	return nil
+}
+
+// Clear removes every element from the filter.
+func (bloomFilter *BloomFilter) Clear() {
+	for i := range bloomFilter.bitArray {
+		bloomFilter.bitArray[i] = 0
+	}
+}
+
+// Copy returns a deep copy of the filter.
+func (bloomFilter *BloomFilter) Copy() *BloomFilter {
+	c := NewBF(bloomFilter.m, bloomFilter.k)
+	copy(c.bitArray, bloomFilter.bitArray)
+	return c
+}
+
+// EstimatedFillRatio returns the fraction of bits that are set.
+func (bloomFilter *BloomFilter) EstimatedFillRatio() float64 {
+	set := 0
+	for _, word := range bloomFilter.bitArray {
+		set += bits.OnesCount64(word)
+	}
+	return float64(set) / float64(bloomFilter.m)
+}
+
+// FalsePositiveRate returns the estimated probability that Check returns true
+// for an element that was never added.
+func (bloomFilter *BloomFilter) FalsePositiveRate() float64 {
+	return math.Pow(bloomFilter.EstimatedFillRatio(), float64(bloomFilter.k))
+}
+
+// Proto returns the wire representation of the filter. Bit i is stored in bit
+// i%8 of byte i/8.
+func (bloomFilter *BloomFilter) Proto() *serverpb.BloomFilter {
+	buf := make([]byte, len(bloomFilter.bitArray)*8)
+	for i, word := range bloomFilter.bitArray {
+		binary.LittleEndian.PutUint64(buf[i*8:], word)
+	}
+	return &serverpb.BloomFilter{
+		K:    uint32(bloomFilter.k),
+		M:    uint32(bloomFilter.m),
+		Bits: buf[:(bloomFilter.m+7)/8],
+	}
+}
+
+// BloomFilterFromProto decodes a filter received from a peer.
+func BloomFilterFromProto(pb *serverpb.BloomFilter) (*BloomFilter, error) {
+	if pb == nil || pb.M == 0 || pb.K == 0 {
+		return nil, errors.Errorf("invalid bloom filter: %+v", pb)
+	}
+	if len(pb.Bits) != int((pb.M+7)/8) {
+		return nil, errors.Errorf("invalid bloom filter: expected %d bytes; got %d", (pb.M+7)/8, len(pb.Bits))
+	}
+	bloomFilter := NewBF(uint(pb.M), uint(pb.K))
+	buf := make([]byte, len(bloomFilter.bitArray)*8)
+	copy(buf, pb.Bits)
+	for i := range bloomFilter.bitArray {
+		bloomFilter.bitArray[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	if extra := uint(len(bloomFilter.bitArray))*64 - bloomFilter.m; extra > 0 {
+		// Ignore any padding bits set by the sender.
+		bloomFilter.bitArray[len(bloomFilter.bitArray)-1] &= math.MaxUint64 >> extra
+	}
+	return bloomFilter, nil
+}
+
+// hashPosition returns the position of an item in a filter of size m for the
+// i-th hash function.
+func hashPosition(item []byte, i int, m uint) uint {
+	hashFunc := murmur3.New64WithSeed(uint32(i))
+	hashFunc.Write(item)
+	res := hashFunc.Sum64()
+
+	return uint(res % uint64(m))
+}
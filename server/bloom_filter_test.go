@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBloomFilterProto(t *testing.T) {
+	for _, size := range []uint{1, 63, 64, 100, 1000} {
+		bf := NewBF(size, 3)
+		bf.Add([]byte("a"))
+		bf.Add([]byte("b"))
+
+		pb := bf.Proto()
+		if want := int((size + 7) / 8); len(pb.Bits) != want {
+			t.Fatalf("%d. expected %d bytes; got %d", size, want, len(pb.Bits))
+		}
+		got, err := BloomFilterFromProto(pb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, bf) {
+			t.Fatalf("%d. got %+v; want %+v", size, got, bf)
+		}
+		if !got.Check([]byte("a")) || !got.Check([]byte("b")) {
+			t.Fatalf("%d. expected decoded filter to contain added items", size)
+		}
+	}
+
+	pb := NewBF(100, 3).Proto()
+	pb.Bits = pb.Bits[1:]
+	if _, err := BloomFilterFromProto(pb); err == nil {
+		t.Fatal("expected error for truncated filter")
+	}
+}
+
+func TestBloomFilterUnionIntersect(t *testing.T) {
+	a := NewBF(1024, 3)
+	a.Add([]byte("a"))
+	a.Add([]byte("both"))
+	b := NewBF(1024, 3)
+	b.Add([]byte("b"))
+	b.Add([]byte("both"))
+
+	union := a.Copy()
+	if err := union.Union(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"a", "b", "both"} {
+		if !union.Check([]byte(item)) {
+			t.Fatalf("expected union to contain %q", item)
+		}
+	}
+
+	intersection := a.Copy()
+	if err := intersection.Intersect(b); err != nil {
+		t.Fatal(err)
+	}
+	if !intersection.Check([]byte("both")) {
+		t.Fatal("expected intersection to contain \"both\"")
+	}
+	if intersection.Check([]byte("a")) && intersection.Check([]byte("b")) {
+		t.Fatal("expected intersection to drop unique items")
+	}
+
+	if err := a.Union(NewBF(100, 3)); err == nil {
+		t.Fatal("expected error for mismatched filters")
+	}
+
+	a.Clear()
+	if a.Check([]byte("a")) || a.EstimatedFillRatio() != 0 {
+		t.Fatal("expected filter to be empty after Clear")
+	}
+}
+
+func TestBloomFilterEstimates(t *testing.T) {
+	const n = 1000
+	const p = 0.01
+
+	bf, err := NewBFWithEstimates(n, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.m < 9000 || bf.k != 7 {
+		t.Fatalf("unexpected parameters m=%d k=%d", bf.m, bf.k)
+	}
+	for i := 0; i < n; i++ {
+		bf.Add([]byte(fmt.Sprint(i)))
+	}
+
+	if fill := bf.EstimatedFillRatio(); fill < 0.4 || fill > 0.6 {
+		t.Fatalf("expected fill ratio near 0.5; got %f", fill)
+	}
+	if fpr := bf.FalsePositiveRate(); fpr > 2*p {
+		t.Fatalf("expected false positive rate near %f; got %f", p, fpr)
+	}
+
+	falsePositives := 0
+	for i := n; i < 11*n; i++ {
+		if bf.Check([]byte(fmt.Sprint(i))) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / (10 * n); rate > 2*p {
+		t.Fatalf("observed false positive rate %f", rate)
+	}
+}
+
+func TestCountingBloomFilter(t *testing.T) {
+	cbf := NewCBF(1024, 3)
+	cbf.Add([]byte("a"))
+	cbf.Add([]byte("b"))
+	cbf.Add([]byte("b"))
+
+	if !cbf.Check([]byte("a")) || !cbf.Check([]byte("b")) {
+		t.Fatal("expected filter to contain added items")
+	}
+
+	cbf.Remove([]byte("a"))
+	if cbf.Check([]byte("a")) {
+		t.Fatal("expected removed item to be gone")
+	}
+	cbf.Remove([]byte("b"))
+	if !cbf.Check([]byte("b")) {
+		t.Fatal("expected item added twice to remain after one removal")
+	}
+
+	bf := cbf.BloomFilter()
+	if !bf.Check([]byte("b")) || bf.Check([]byte("a")) {
+		t.Fatal("expected bloom filter to match counting filter")
+	}
+
+	cbf.Clear()
+	if cbf.Check([]byte("b")) {
+		t.Fatal("expected filter to be empty after Clear")
+	}
+}
+
+func TestBloomFilterParamsInvalid(t *testing.T) {
+	for _, p := range []float64{0, -0.5, 1, 2, math.NaN()} {
+		if _, _, err := BloomFilterParams(100, p); err == nil {
+			t.Errorf("expected error for false positive rate %v", p)
+		}
+	}
+
+	// Tiny filters still have at least one bit.
+	size, numHashFuncs, err := BloomFilterParams(1, 0.99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < 1 || numHashFuncs < 1 {
+		t.Fatalf("expected at least one bit and hash function; got m=%d k=%d", size, numHashFuncs)
+	}
+	bf := NewBF(0, 1)
+	bf.Add([]byte("doc"))
+	if !bf.Check([]byte("doc")) {
+		t.Fatal("expected empty sized filter to still work")
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+
+	"github.com/pkg/errors"
+)
+
+// Content defined chunking parameters. Blocks are never larger than
+// blockSize.
+const (
+	cdcMinSize = 16 * 1024
+	cdcAvgSize = 64 * 1024
+	cdcMaxSize = blockSize
+
+	// Normalized chunking: a harder mask is used before the average size and
+	// an easier one after it, which narrows the block size distribution.
+	cdcMaskS = uint64(1<<18-1) << (64 - 18)
+	cdcMaskL = uint64(1<<14-1) << (64 - 14)
+)
+
+// Chunker splits a stream of data into blocks.
+type Chunker interface {
+	// Next returns the next block or io.EOF after the last one. The block is
+	// only valid until the next call.
+	Next() ([]byte, error)
+}
+
+func newChunker(kind serverpb.Chunker, r io.Reader) (Chunker, error) {
+	switch kind {
+	case serverpb.FIXED:
+		return &fixedChunker{r: r, buf: make([]byte, blockSize)}, nil
+	case serverpb.FASTCDC:
+		return &fastCDCChunker{r: r, buf: make([]byte, cdcMaxSize)}, nil
+	default:
+		return nil, errors.Errorf("unknown chunker %s", kind)
+	}
+}
+
+// fixedChunker splits data into blocks of blockSize bytes.
+type fixedChunker struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	if n > 0 {
+		return c.buf[:n], nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return nil, err
+}
+
+// fastCDCChunker splits data at content defined boundaries using the FastCDC
+// algorithm, so an insertion only changes the blocks around it.
+type fastCDCChunker struct {
+	r    io.Reader
+	buf  []byte
+	data []byte // unconsumed part of buf
+	eof  bool
+}
+
+func (c *fastCDCChunker) Next() ([]byte, error) {
+	if len(c.data) < cdcMaxSize && !c.eof {
+		n := copy(c.buf, c.data)
+		m, err := io.ReadFull(c.r, c.buf[n:])
+		c.data = c.buf[:n+m]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.data) == 0 {
+		return nil, io.EOF
+	}
+	n := fastCDCCut(c.data)
+	block := c.data[:n]
+	c.data = c.data[n:]
+	return block, nil
+}
+
+// fastCDCCut returns the length of the first block of data.
+func fastCDCCut(data []byte) int {
+	n := len(data)
+	if n <= cdcMinSize {
+		return n
+	}
+	if n > cdcMaxSize {
+		n = cdcMaxSize
+	}
+	normal := cdcAvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := cdcMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&cdcMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&cdcMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gearTable maps every byte to a random value for the gear rolling hash. It
+// is generated from a fixed seed so all nodes split files identically.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6970667321)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+)
+
+func chunk(t *testing.T, kind serverpb.Chunker, data []byte) [][]byte {
+	chunks, err := newChunker(kind, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks [][]byte
+	for {
+		block, err := chunks.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, append([]byte{}, block...))
+	}
+	if got := bytes.Join(blocks, nil); !bytes.Equal(got, data) {
+		t.Fatalf("%s: blocks don't reassemble to the input", kind)
+	}
+	return blocks
+}
+
+func TestFixedChunker(t *testing.T) {
+	data := make([]byte, 2*blockSize+10)
+	blocks := chunk(t, serverpb.FIXED, data)
+	if len(blocks) != 3 || len(blocks[0]) != blockSize || len(blocks[2]) != 10 {
+		t.Fatalf("unexpected blocks: %d", len(blocks))
+	}
+	if blocks := chunk(t, serverpb.FIXED, nil); len(blocks) != 0 {
+		t.Fatalf("expected no blocks; got %d", len(blocks))
+	}
+}
+
+func TestFastCDCChunker(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	blocks := chunk(t, serverpb.FASTCDC, data)
+	for i, block := range blocks {
+		if len(block) > cdcMaxSize || (len(block) < cdcMinSize && i != len(blocks)-1) {
+			t.Fatalf("block %d has invalid size %d", i, len(block))
+		}
+	}
+	if avg := len(data) / len(blocks); avg < cdcAvgSize/2 || avg > 2*cdcAvgSize {
+		t.Fatalf("unexpected average block size %d", avg)
+	}
+
+	// Inserting a byte near the start should only change the first blocks.
+	modified := append([]byte{data[0], 'x'}, data[1:]...)
+	seen := map[[sha1.Size]byte]bool{}
+	for _, block := range blocks {
+		seen[sha1.Sum(block)] = true
+	}
+	shared := 0
+	modifiedBlocks := chunk(t, serverpb.FASTCDC, modified)
+	for _, block := range modifiedBlocks {
+		if seen[sha1.Sum(block)] {
+			shared++
+		}
+	}
+	if shared < len(modifiedBlocks)-2 {
+		t.Fatalf("expected all but the first blocks to be shared; %d of %d shared", shared, len(modifiedBlocks))
+	}
+
+	fixed := chunk(t, serverpb.FIXED, data)
+	fixedModified := chunk(t, serverpb.FIXED, modified)
+	if bytes.Equal(fixed[1], fixedModified[1]) {
+		t.Fatal("expected fixed size blocks to shift after an insertion")
+	}
+}
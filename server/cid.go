@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Document IDs are self describing: a multibase prefix followed by the
+// encoding of a version byte and a multihash (hash function code, digest
+// length and digest), so the hash function can change without breaking
+// existing IDs. The only multibase supported is "b", lowercase base32 without
+// padding, which is safe to use in paths and URLs.
+//
+// IDs created before this format were the standard base64 encoding of the
+// SHA-1 of the document and are still accepted.
+
+const (
+	idVersion        = 1
+	idMultibase      = "b"
+	defaultHashFunc  = "sha2-256"
+	legacyDigestSize = sha1.Size
+)
+
+// Multihash function codes.
+const (
+	hashSHA1   = 0x11
+	hashSHA256 = 0x12
+	hashSHA512 = 0x13
+)
+
+var hashFuncCodes = map[string]uint64{
+	"sha1":     hashSHA1,
+	"sha2-256": hashSHA256,
+	"sha2-512": hashSHA512,
+}
+
+var idEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// hashFuncCode returns the multihash code of the hash function named to
+// create new document IDs with. An empty name selects the default. sha1 isn't
+// collision resistant, so it is only used to verify existing IDs.
+func hashFuncCode(name string) (uint64, error) {
+	if name == "" {
+		name = defaultHashFunc
+	}
+	code, ok := hashFuncCodes[name]
+	if !ok {
+		return 0, errors.Errorf("unknown hash function %q", name)
+	}
+	if code == hashSHA1 {
+		return 0, errors.Errorf("hash function %q isn't collision resistant; use sha2-256 or sha2-512", name)
+	}
+	return code, nil
+}
+
+func digest(code uint64, body []byte) ([]byte, error) {
+	switch code {
+	case hashSHA1:
+		sum := sha1.Sum(body)
+		return sum[:], nil
+	case hashSHA256:
+		sum := sha256.Sum256(body)
+		return sum[:], nil
+	case hashSHA512:
+		sum := sha512.Sum512(body)
+		return sum[:], nil
+	default:
+		return nil, errors.Errorf("unsupported hash function code 0x%x", code)
+	}
+}
+
+// encodeID returns the ID for a digest created with the specified hash
+// function.
+func encodeID(code uint64, digest []byte) string {
+	var buf bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.WriteByte(idVersion)
+	buf.Write(varint[:binary.PutUvarint(varint, code)])
+	buf.Write(varint[:binary.PutUvarint(varint, uint64(len(digest)))])
+	buf.Write(digest)
+	return idMultibase + idEncoding.EncodeToString(buf.Bytes())
+}
+
+// parseID returns the hash function code and digest of an ID.
+func parseID(id string) (uint64, []byte, error) {
+	if strings.HasPrefix(id, idMultibase) {
+		if code, digest, err := parseMultihashID(id); err == nil {
+			return code, digest, nil
+		}
+	}
+	if legacy, err := base64.StdEncoding.DecodeString(id); err == nil && len(legacy) == legacyDigestSize {
+		return hashSHA1, legacy, nil
+	}
+	return 0, nil, errors.Errorf("invalid document ID %q", id)
+}
+
+func parseMultihashID(id string) (uint64, []byte, error) {
+	raw, err := idEncoding.DecodeString(strings.TrimPrefix(id, idMultibase))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(raw) == 0 || raw[0] != idVersion {
+		return 0, nil, errors.Errorf("unsupported ID version")
+	}
+	raw = raw[1:]
+	code, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return 0, nil, errors.Errorf("invalid hash function code")
+	}
+	raw = raw[n:]
+	length, n := binary.Uvarint(raw)
+	if n <= 0 || uint64(len(raw)-n) != length {
+		return 0, nil, errors.Errorf("invalid digest length")
+	}
+	return code, raw[n:], nil
+}
+
+// verifyID checks that a marshalled document hashes to the specified ID using
+// the hash function recorded in the ID.
+func verifyID(id string, body []byte) error {
+	code, want, err := parseID(id)
+	if err != nil {
+		return err
+	}
+	got, err := digest(code, body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return errors.Errorf("document doesn't match ID %s", id)
+	}
+	return nil
+}
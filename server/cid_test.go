@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+	"testing"
+)
+
+func TestDocumentIDs(t *testing.T) {
+	body := []byte("hello world")
+
+	for name, code := range hashFuncCodes {
+		d, err := digest(code, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := encodeID(code, d)
+		if !strings.HasPrefix(id, idMultibase) || strings.ContainsAny(id, "/+=") {
+			t.Fatalf("%s: invalid ID %q", name, id)
+		}
+		if err := verifyID(id, body); err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if err := verifyID(id, []byte("other")); err == nil {
+			t.Fatalf("%s: expected verification of different data to fail", name)
+		}
+	}
+
+	// IDs created before the multihash format are still valid.
+	sum := sha1.Sum(body)
+	legacy := base64.StdEncoding.EncodeToString(sum[:])
+	if err := verifyID(legacy, body); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"", "b", "bzzzz", "not an id", legacy[:10]} {
+		if err := verifyID(id, body); err == nil {
+			t.Fatalf("expected %q to be invalid", id)
+		}
+	}
+}
+
+func TestHashFunctionConfig(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	code, _, err := parseID(s.hashDocument([]byte("a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != hashSHA256 {
+		t.Fatalf("expected sha2-256 by default; got 0x%x", code)
+	}
+
+	s512, stop512 := newTestServer(t, func(c *serverpb.NodeConfig) {
+		c.HashFunction = "sha2-512"
+	})
+	defer stop512()
+	id := s512.hashDocument([]byte("a"))
+	code, _, err = parseID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != hashSHA512 {
+		t.Fatalf("expected sha2-512; got 0x%x", code)
+	}
+	if err := verifyID(id, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"md5", "sha1"} {
+		if _, err := New(serverpb.NodeConfig{Path: "unused", HashFunction: name}); err == nil {
+			t.Fatalf("expected hash function %q to be rejected", name)
+		}
+	}
+}
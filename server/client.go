@@ -2,61 +2,77 @@ package server
 
 import (
 	"context"
-	"crypto/sha1"
 	"encoding/asn1"
 	"encoding/base64"
-	"fmt"
+	"io/ioutil"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 	"time"
 
-	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
 )
 
 func (s *Server) Get(ctx context.Context, in *serverpb.GetRequest) (*serverpb.GetResponse, error) {
-	var f serverpb.Document
-	if err := s.db.View(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("/document/%s", in.DocumentId)
-		item, err := txn.Get([]byte(key))
+	id, f, key, err := s.resolvePath(ctx, in.DocumentId)
+	if err != nil {
+		return nil, err
+	}
+	if in.Offset != 0 || in.Length != 0 {
+		r, err := s.readRange(ctx, f, key, in.Offset, in.Length, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		body, err := item.Value()
+		f.Data, err = ioutil.ReadAll(r)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if err := f.Unmarshal(body); err != nil {
-			return err
+		f.Blocks = nil
+	} else {
+		f, err = s.assembleDocument(ctx, f, key)
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	}); err != nil {
-		return nil, err
 	}
 
 	resp := &serverpb.GetResponse{
-		Document: &f,
+		Document:   &f,
+		DocumentId: id,
 	}
 
 	return resp, nil
 }
 
 func (s *Server) Add(ctx context.Context, in *serverpb.AddRequest) (*serverpb.AddResponse, error) {
-	b, err := in.Document.Marshal()
+	if in.Document == nil {
+		return nil, errors.Errorf("missing document")
+	}
+	if len(in.Document.Blocks) > 0 || in.Document.Length != 0 {
+		return nil, errors.Errorf("blocks are set by the server; send the data of the document")
+	}
+
+	key, err := addKey(in.Encrypt, *in.Document)
 	if err != nil {
 		return nil, err
 	}
 
-	data := sha1.Sum(b)
-	hash := base64.StdEncoding.EncodeToString(data[:])
-
-	if err := s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(fmt.Sprintf("/document/%s", hash)), b)
-	}); err != nil {
+	hash, release, err := s.addDocument(*in.Document, in.Chunker, key)
+	if err != nil {
 		return nil, err
 	}
+	if in.NoPin {
+		s.leaseAdded(release)
+	} else {
+		defer release()
+		if err := s.pinAdded(hash, in.ReplicationFactor); err != nil {
+			return nil, err
+		}
+	}
 
 	resp := &serverpb.AddResponse{
 		DocumentId: hash,
 	}
+	if key != nil {
+		resp.Capability = formatCapability(hash, key)
+	}
 
 	return resp, nil
 }
@@ -92,63 +108,68 @@ func (s *Server) AddPeer(ctx context.Context, in *serverpb.AddPeerRequest) (*ser
 }
 
 func (s *Server) GetReference(ctx context.Context, in *serverpb.GetReferenceRequest) (*serverpb.GetReferenceResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if reference, ok := s.mu.references[in.GetReferenceId()]; ok {
-		resp := &serverpb.GetReferenceResponse{
-			Reference: &reference,
-		}
-		return resp, nil
+	reference, err := s.findReference(ctx, in.GetReferenceId(), nil, documentTTL, newRequestID())
+	if err != nil {
+		return nil, err
+	}
+	resp := &serverpb.GetReferenceResponse{
+		Reference: reference,
 	}
-	// TODO: Do a network lookup for this reference
-	resp := &serverpb.GetReferenceResponse{}
 	return resp, nil
 }
 
 func (s *Server) AddReference(ctx context.Context, in *serverpb.AddReferenceRequest) (*serverpb.AddReferenceResponse, error) {
 	privKey, err := LoadPrivate(in.GetPrivKey())
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	pubKey, err := MarshalPublic(&privKey.PublicKey)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
-	// Create reference
+	referenceId, err := Hash(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	// Create reference, newer than any previous version even if it was
+	// published within the same second.
+	timestamp := time.Now().Unix()
+	s.mu.Lock()
+	if previous, ok := s.mu.references[referenceId]; ok && previous.Timestamp >= timestamp {
+		timestamp = previous.Timestamp + 1
+	}
+	s.mu.Unlock()
 	reference := &serverpb.Reference{
 		Value:     in.GetRecord(),
 		PublicKey: pubKey,
-		Timestamp: time.Now().Unix(),
+		Timestamp: timestamp,
 	}
-	bytes, err := reference.Marshal()
+	digest, err := referenceDigest(*reference)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
-	r, s1, err := Sign(bytes, *privKey)
+	r, s1, err := Sign(digest, *privKey)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	sig, err := asn1.Marshal(EcdsaSignature{R: r, S: s1})
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	reference.Signature = base64.StdEncoding.EncodeToString(sig)
 
-	// Add this reference locally
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	referenceId, err := Hash(reference.PublicKey)
-	if err != nil {
+	// Add this reference locally and disseminate it to the rest of the
+	// network
+	if _, err := s.storeReference(*reference); err != nil {
 		return nil, err
 	}
-	s.mu.references[referenceId] = *reference
-	// TODO: Diseminate this reference to the rest of the network
+	if s.dhtMode() {
+		if err := s.dhtPutReference(ctx, referenceId, *reference); err != nil {
+			return nil, err
+		}
+	} else {
+		s.publishReference(ctx, *reference, nil, documentTTL)
+	}
 	resp := &serverpb.AddReferenceResponse{
 		ReferenceId: referenceId,
 	}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// Documents may be stored compressed. A compressed document starts with
+// compressionMarker followed by the codec and the compressed data. Marshalled
+// documents never start with a zero byte since it isn't a valid field tag, so
+// documents stored uncompressed, including those stored before compression
+// was supported, are read as is. putDocument rejects any other body, as
+// documents received from peers are only checked against their hash. Document IDs are always computed over the
+// uncompressed document.
+
+const compressionMarker = 0x00
+
+// Compression codecs.
+const (
+	codecNone   = 0x00
+	codecSnappy = 0x01
+)
+
+var compressionCodecs = map[string]byte{
+	"none":   codecNone,
+	"snappy": codecSnappy,
+}
+
+// compressionCodec returns the codec for a compression name. An empty name
+// disables compression.
+func compressionCodec(name string) (byte, error) {
+	if name == "" {
+		return codecNone, nil
+	}
+	codec, ok := compressionCodecs[name]
+	if !ok {
+		return 0, errors.Errorf("unknown compression %q", name)
+	}
+	return codec, nil
+}
+
+// compressDocument returns the stored form of a marshalled document. The
+// document is stored uncompressed if compressing it doesn't save space.
+func compressDocument(codec byte, body []byte) []byte {
+	switch codec {
+	case codecSnappy:
+		compressed := make([]byte, 2, 2+snappy.MaxEncodedLen(len(body)))
+		compressed[0] = compressionMarker
+		compressed[1] = codecSnappy
+		compressed = append(compressed, snappy.Encode(nil, body)...)
+		if len(compressed) < len(body) {
+			return compressed
+		}
+	}
+	return body
+}
+
+// decompressDocument returns the marshalled document from its stored form.
+func decompressDocument(stored []byte) ([]byte, error) {
+	if len(stored) == 0 || stored[0] != compressionMarker {
+		return stored, nil
+	}
+	if len(stored) < 2 {
+		return nil, errors.New("truncated compressed document")
+	}
+	switch stored[1] {
+	case codecSnappy:
+		body, err := snappy.Decode(nil, stored[2:])
+		if err != nil {
+			return nil, errors.Wrap(err, "snappy")
+		}
+		return body, nil
+	default:
+		return nil, errors.Errorf("unknown compression codec %d", stored[1])
+	}
+}
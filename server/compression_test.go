@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestCompressedDocuments(t *testing.T) {
+	s, stop := newTestServer(t, func(c *serverpb.NodeConfig) {
+		c.Compression = "snappy"
+	})
+	defer stop()
+
+	ctx := context.Background()
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 1000)
+	random := []byte{0x8e, 0x2f, 0x51}
+
+	for _, data := range [][]byte{text, random} {
+		doc := serverpb.Document{Data: data}
+		body, err := doc.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := s.Add(ctx, &serverpb.AddRequest{Document: &doc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The ID is computed over the uncompressed document.
+		if resp.DocumentId != s.hashDocument(body) {
+			t.Fatalf("expected ID %s; got %s", s.hashDocument(body), resp.DocumentId)
+		}
+
+		var stored []byte
+		if err := s.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(documentKey(resp.DocumentId))
+			if err != nil {
+				return err
+			}
+			stored, err = item.ValueCopy(nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if compressed := stored[0] == compressionMarker; compressed != (len(data) == len(text)) {
+			t.Errorf("%d bytes: expected compressed=%t", len(data), !compressed)
+		}
+
+		got, err := s.localDocument(resp.DocumentId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Fatalf("%d bytes: stored document doesn't round trip", len(data))
+		}
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	if _, err := compressionCodec("lz77"); err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+	if _, err := decompressDocument([]byte{compressionMarker, 0xff}); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+}
+
+func TestPutInvalidDocument(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	// A body a peer could send under its true hash that would be read back as
+	// compressed.
+	doc := serverpb.Document{Data: []byte("hello")}
+	body, err := doc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := compressDocument(codecSnappy, bytes.Repeat(body, 100))
+	for i, body := range [][]byte{compressed, {0xff, 0xff}} {
+		if err := s.putDocument(s.hashDocument(body), body); err == nil {
+			t.Errorf("%d. expected invalid document to be rejected", i)
+		}
+	}
+}
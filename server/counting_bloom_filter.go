@@ -0,0 +1,71 @@
+package server
+
+import "math"
+
+// CountingBloomFilter is a bloom filter that supports removal. Every position
+// holds a counter instead of a bit. Counters saturate at 255 and are never
+// decremented after that, so removal can't introduce false negatives.
+type CountingBloomFilter struct {
+	counters []uint8
+	k        uint
+	m        uint
+}
+
+func NewCBF(size, numHashFuncs uint) *CountingBloomFilter {
+	countingBloomFilter := CountingBloomFilter{
+		counters: make([]uint8, size),
+		k:        numHashFuncs,
+		m:        size,
+	}
+
+	return &countingBloomFilter
+}
+
+func (cbf *CountingBloomFilter) Add(item []byte) {
+	for i := 0; i < int(cbf.k); i++ {
+		pos := hashPosition(item, i, cbf.m)
+		if cbf.counters[pos] < math.MaxUint8 {
+			cbf.counters[pos]++
+		}
+	}
+}
+
+// Remove removes an item that was previously added. Removing an item that was
+// never added may cause false negatives for other items.
+func (cbf *CountingBloomFilter) Remove(item []byte) {
+	for i := 0; i < int(cbf.k); i++ {
+		pos := hashPosition(item, i, cbf.m)
+		if cbf.counters[pos] > 0 && cbf.counters[pos] < math.MaxUint8 {
+			cbf.counters[pos]--
+		}
+	}
+}
+
+func (cbf *CountingBloomFilter) Check(item []byte) (exists bool) {
+	for i := 0; i < int(cbf.k); i++ {
+		pos := hashPosition(item, i, cbf.m)
+		if cbf.counters[pos] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Clear removes every element from the filter.
+func (cbf *CountingBloomFilter) Clear() {
+	for i := range cbf.counters {
+		cbf.counters[i] = 0
+	}
+}
+
+// BloomFilter returns a plain bloom filter with a bit set for every non-zero
+// counter. It has the same size and hash functions as cbf.
+func (cbf *CountingBloomFilter) BloomFilter() *BloomFilter {
+	bf := NewBF(cbf.m, cbf.k)
+	for pos, count := range cbf.counters {
+		if count > 0 {
+			bf.bitArray[pos/64] |= 1 << (uint(pos) % 64)
+		}
+	}
+	return bf
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+
+	"github.com/pkg/errors"
+)
+
+// blockSize is the maximum size of the data stored in a single document.
+// Larger files are split into blocks linked from a root document.
+const blockSize = 256 * 1024
+
+// storeDocument marshals and stores a single document and returns its ID.
+func (s *Server) storeDocument(doc serverpb.Document) (string, error) {
+	body, err := doc.Marshal()
+	if err != nil {
+		return "", err
+	}
+	id := s.hashDocument(body)
+	if err := s.putDocument(id, body); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// storeEncrypted stores a single document encrypted with key, or as is if key
+// is nil, and returns its ID.
+func (s *Server) storeEncrypted(doc serverpb.Document, key []byte) (string, error) {
+	if key != nil {
+		var err error
+		doc, err = encryptDocument(key, doc)
+		if err != nil {
+			return "", err
+		}
+	}
+	return s.storeDocument(doc)
+}
+
+// openDocument returns the document with the specified ID, decrypted with key
+// if it isn't nil.
+func (s *Server) openDocument(ctx context.Context, id string, key []byte) (serverpb.Document, error) {
+	doc, err := s.getDocument(ctx, id)
+	if err != nil || key == nil {
+		return doc, err
+	}
+	return decryptDocument(key, doc)
+}
+
+// addDocument stores a document and returns its ID. If the data doesn't fit
+// in a single block it is split with the specified chunker and the ID of the
+// root document linking the blocks is returned. If key isn't nil every
+// document is encrypted with it. The stored documents are kept until release
+// is called, see addFile.
+func (s *Server) addDocument(doc serverpb.Document, chunker serverpb.Chunker, key []byte) (id string, release func(), err error) {
+	data := doc.Data
+	doc.Data = nil
+	return s.addFile(doc, bytes.NewReader(data), chunker, key)
+}
+
+// addFile stores the data read from r with the content type and children of
+// doc and returns the document ID. Only one block is held in memory at a
+// time. Files that fit in a single block are stored as one document.
+//
+// gcMu is only held while storing each document, not while reading r, so a
+// slow client doesn't hold up garbage collection. Garbage collection and
+// eviction keep the stored documents until release is called; callers pin the
+// root before releasing it.
+func (s *Server) addFile(doc serverpb.Document, r io.Reader, chunker serverpb.Chunker, key []byte) (id string, release func(), err error) {
+	chunks, err := newChunker(chunker, r)
+	if err != nil {
+		return "", nil, err
+	}
+	a := &adder{s: s}
+	release = a.release
+	store := func(doc serverpb.Document) (string, error) {
+		return a.hold(func() (string, error) {
+			return s.storeEncrypted(doc, key)
+		})
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	var first []byte
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+		if first == nil && len(doc.Blocks) == 0 {
+			// Hold back the first block until we know whether the file needs
+			// to be chunked.
+			first = append([]byte{}, data...)
+			continue
+		}
+		if first != nil {
+			if err := addBlock(&doc, first, store); err != nil {
+				return "", nil, err
+			}
+			first = nil
+		}
+		if err := addBlock(&doc, data, store); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(doc.Blocks) == 0 {
+		doc.Data = first
+	}
+	id, err = store(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, release, nil
+}
+
+// adder keeps the documents stored by an add from being garbage collected or
+// evicted until release is called. gcMu is only held while storing each
+// document.
+type adder struct {
+	s      *Server
+	stored []string
+}
+
+// hold runs store, which stores a document and returns its ID, under gcMu and
+// keeps the document until release is called.
+func (a *adder) hold(store func() (string, error)) (string, error) {
+	s := a.s
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	if s.stopped() {
+		return "", ErrStopped
+	}
+	id, err := store()
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.mu.adding[id]++
+	s.mu.Unlock()
+	a.stored = append(a.stored, id)
+	return id, nil
+}
+
+// release lets garbage collection and eviction remove the documents held.
+func (a *adder) release() {
+	s := a.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range a.stored {
+		s.mu.adding[id]--
+		if s.mu.adding[id] == 0 {
+			delete(s.mu.adding, id)
+		}
+	}
+	a.stored = nil
+}
+
+// addBlock stores a block of a chunked file with store and links it from the
+// root.
+func addBlock(root *serverpb.Document, data []byte, store func(serverpb.Document) (string, error)) error {
+	id, err := store(serverpb.Document{
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+	root.Blocks = append(root.Blocks, &serverpb.Link{
+		Id:     id,
+		Length: int64(len(data)),
+	})
+	root.Length += int64(len(data))
+	return nil
+}
+
+// assembleDocument fetches the blocks of a chunked file, decrypting them with
+// key if it isn't nil, and reassembles them into Data.
+func (s *Server) assembleDocument(ctx context.Context, doc serverpb.Document, key []byte) (serverpb.Document, error) {
+	if len(doc.Blocks) == 0 {
+		return doc, nil
+	}
+	if err := validateFile(doc); err != nil {
+		return serverpb.Document{}, err
+	}
+
+	var ids []string
+	for _, link := range doc.Blocks {
+		ids = append(ids, link.Id)
+	}
+	if err := s.fetchBlocks(ctx, ids); err != nil {
+		return serverpb.Document{}, err
+	}
+
+	// Length comes from the root document, which may have been sent by any
+	// peer, so the data isn't preallocated from it.
+	var data []byte
+	for _, link := range doc.Blocks {
+		block, err := s.openDocument(ctx, link.Id, key)
+		if err != nil {
+			return serverpb.Document{}, err
+		}
+		data = append(data, block.Data...)
+	}
+	doc.Data = data
+	doc.Blocks = nil
+	return doc, nil
+}
+
+// documentLinks returns the IDs of the documents linked from doc.
+func documentLinks(doc serverpb.Document) []string {
+	var links []string
+	for _, id := range doc.Children {
+		links = append(links, id)
+	}
+	for _, link := range doc.Blocks {
+		links = append(links, link.Id)
+	}
+	return links
+}
+
+// fetchDAG makes sure a document and everything linked from it are stored
+// locally, fetching missing documents from the network. Each level of the DAG
+// is fetched from every peer at once over block exchange.
+func (s *Server) fetchDAG(ctx context.Context, id string) error {
+	seen := map[string]bool{id: true}
+	level := []string{id}
+	for len(level) > 0 {
+		if err := s.fetchBlocks(ctx, level); err != nil {
+			return err
+		}
+		var next []string
+		for _, id := range level {
+			doc, err := s.getDocument(ctx, id)
+			if err != nil {
+				return err
+			}
+			for _, link := range documentLinks(doc) {
+				if !seen[link] {
+					seen[link] = true
+					next = append(next, link)
+				}
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+// dagReader reads the data of a file, fetching the blocks of a chunked file one
+// at a time. Seeking only fetches the block containing the new offset.
+type dagReader struct {
+	ctx    context.Context
+	s      *Server
+	doc    serverpb.Document
+	key    []byte // key the blocks are encrypted with, if any
+	offset int64  // offset of the next byte to read
+	block  int    // index of the next block to fetch
+	skip   int64  // bytes to skip at the start of the next block
+	buf    []byte // unread data of the current block
+	// blocks prefetches the blocks read, if set. Reads must then follow
+	// the blocks it was created with.
+	blocks *downloader
+}
+
+func (s *Server) newDAGReader(ctx context.Context, doc serverpb.Document, key []byte) *dagReader {
+	return &dagReader{
+		ctx: ctx,
+		s:   s,
+		doc: doc,
+		key: key,
+		buf: doc.Data,
+	}
+}
+
+// validateFile checks that the length of a chunked file is the sum of the
+// lengths of its blocks. Root documents are only checked against their hash,
+// so the lengths may come from any client or peer.
+func validateFile(doc serverpb.Document) error {
+	var length int64
+	for _, link := range doc.Blocks {
+		if link.Length < 0 || link.Length > math.MaxInt64-length {
+			return errors.Errorf("file has invalid block length %d", link.Length)
+		}
+		length += link.Length
+	}
+	if len(doc.Blocks) > 0 && doc.Length != length {
+		return errors.Errorf("file has length %d; its blocks have %d bytes", doc.Length, length)
+	}
+	return nil
+}
+
+// fileLength returns the length of the data of a file, which must have been
+// checked with validateFile.
+func fileLength(doc serverpb.Document) int64 {
+	if len(doc.Blocks) == 0 {
+		return int64(len(doc.Data))
+	}
+	return doc.Length
+}
+
+func (r *dagReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.block >= len(r.doc.Blocks) {
+			return 0, io.EOF
+		}
+		var block serverpb.Document
+		var err error
+		if r.blocks != nil {
+			block, err = r.blocks.next(r.doc.Blocks[r.block].Id)
+		} else {
+			block, err = r.s.openDocument(r.ctx, r.doc.Blocks[r.block].Id, r.key)
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.block++
+		if r.skip > int64(len(block.Data)) {
+			r.skip = int64(len(block.Data))
+		}
+		r.buf = block.Data[r.skip:]
+		r.skip = 0
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *dagReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += fileLength(r.doc)
+	default:
+		return 0, errors.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.Errorf("negative offset %d", offset)
+	}
+
+	r.offset = offset
+	r.buf = nil
+	r.skip = 0
+	if len(r.doc.Blocks) == 0 {
+		r.block = 0
+		if offset < int64(len(r.doc.Data)) {
+			r.buf = r.doc.Data[offset:]
+		}
+		return offset, nil
+	}
+	r.block = len(r.doc.Blocks)
+	for i, link := range r.doc.Blocks {
+		if offset < link.Length {
+			r.block = i
+			r.skip = offset
+			break
+		}
+		offset -= link.Length
+	}
+	return r.offset, nil
+}
+
+// readRange returns a reader over length bytes of the data of a file starting
+// at offset. A length of 0 reads to the end of the file. If blocks isn't nil
+// the blocks are read from it; it must be created with the blocks of the
+// range, see rangeBlocks.
+func (s *Server) readRange(ctx context.Context, doc serverpb.Document, key []byte, offset, length int64, blocks *downloader) (io.Reader, error) {
+	if offset < 0 || length < 0 {
+		return nil, errors.Errorf("invalid range: offset %d, length %d", offset, length)
+	}
+	if offset > fileLength(doc) {
+		return nil, errors.Errorf("offset %d is past the end of the file (%d bytes)", offset, fileLength(doc))
+	}
+	r := s.newDAGReader(ctx, doc, key)
+	r.blocks = blocks
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return r, nil
+	}
+	return io.LimitReader(r, length), nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+)
+
+func TestChunkedDocument(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	data := make([]byte, 2*blockSize+100)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	resp, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			Data:        data,
+			ContentType: "application/octet-stream",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := s.getDocument(ctx, resp.DocumentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Blocks) != 3 || len(root.Data) != 0 || root.Length != int64(len(data)) {
+		t.Fatalf("unexpected root document: %d blocks, %d bytes of data, length %d", len(root.Blocks), len(root.Data), root.Length)
+	}
+
+	got, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: resp.DocumentId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Document.Data, data) {
+		t.Fatal("reassembled data doesn't match")
+	}
+	if got.Document.ContentType != "application/octet-stream" {
+		t.Fatalf("unexpected content type %q", got.Document.ContentType)
+	}
+}
+
+func TestInvalidFileLength(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	block, err := s.storeDocument(serverpb.Document{Data: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			Blocks: []*serverpb.Link{{Id: block, Length: 5}},
+			Length: 5,
+		},
+	}); err == nil {
+		t.Fatal("expected documents with blocks to be rejected")
+	}
+
+	for i, root := range []serverpb.Document{
+		{Blocks: []*serverpb.Link{{Id: block, Length: 5}}, Length: -1},
+		{Blocks: []*serverpb.Link{{Id: block, Length: 5}}, Length: 1 << 40},
+		{Blocks: []*serverpb.Link{{Id: block, Length: -5}, {Id: block, Length: 10}}, Length: 5},
+	} {
+		id, err := s.storeDocument(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: id}); err == nil {
+			t.Errorf("%d. expected invalid file to be rejected", i)
+		}
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	data := make([]byte, 2*blockSize+100)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	for _, doc := range []serverpb.Document{
+		{Data: data},
+		{Data: data[:100]},
+	} {
+		resp, err := s.Add(ctx, &serverpb.AddRequest{Document: &doc})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range []struct {
+			offset, length int64
+		}{
+			{0, 10},
+			{50, 0},
+			{blockSize - 5, 10},
+			{blockSize, blockSize + 50},
+			{int64(len(doc.Data)), 0},
+			{int64(len(doc.Data)) - 1, 100},
+			{int64(len(doc.Data)) + 1, 0},
+			{int64(len(doc.Data)) + 1, 10},
+		} {
+			got, err := s.Get(ctx, &serverpb.GetRequest{
+				DocumentId: resp.DocumentId,
+				Offset:     r.offset,
+				Length:     r.length,
+			})
+			if r.offset > int64(len(doc.Data)) {
+				if err == nil {
+					t.Errorf("expected error for offset %d", r.offset)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := int64(len(doc.Data))
+			if r.length != 0 && r.offset+r.length < end {
+				end = r.offset + r.length
+			}
+			if !bytes.Equal(got.Document.Data, doc.Data[r.offset:end]) {
+				t.Errorf("%d byte file, offset %d, length %d: got %d bytes", len(doc.Data), r.offset, r.length, len(got.Document.Data))
+			}
+		}
+	}
+
+	if _, err := s.Get(ctx, &serverpb.GetRequest{
+		DocumentId: s.hashDocument(nil),
+		Offset:     -1,
+	}); err == nil {
+		t.Fatal("expected error for negative offset")
+	}
+}
+
+func TestRangeBlocks(t *testing.T) {
+	doc := serverpb.Document{
+		Blocks: []*serverpb.Link{
+			{Id: "a", Length: 10},
+			{Id: "b", Length: 10},
+			{Id: "c", Length: 5},
+		},
+		Length: 25,
+	}
+	cases := []struct {
+		offset, length int64
+		want           []string
+	}{
+		{0, 0, []string{"a", "b", "c"}},
+		{0, 10, []string{"a"}},
+		{5, 10, []string{"a", "b"}},
+		{10, 0, []string{"b", "c"}},
+		{24, 1, []string{"c"}},
+		{25, 0, nil},
+	}
+	for i, c := range cases {
+		got := rangeBlocks(doc, c.offset, c.length)
+		if len(got) != len(c.want) {
+			t.Errorf("%d. expected %v; got %v", i, c.want, got)
+			continue
+		}
+		for j := range got {
+			if got[j] != c.want[j] {
+				t.Errorf("%d. expected %v; got %v", i, c.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestDownloaderLocal(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	data := make([]byte, 3*blockSize+10)
+	rand.New(rand.NewSource(0)).Read(data)
+	resp, err := s.Add(ctx, &serverpb.AddRequest{Document: &serverpb.Document{Data: data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := s.getDocument(ctx, resp.DocumentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, length := int64(blockSize+5), int64(blockSize+10)
+	// Files stored locally don't report download progress.
+	blocks := s.newDownloader(ctx, rangeBlocks(doc, offset, length), nil, func(p serverpb.DownloadProgress) error {
+		t.Errorf("unexpected progress %+v", p)
+		return nil
+	})
+	defer blocks.close()
+	r, err := s.readRange(ctx, doc, nil, offset, length, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[offset:offset+length]) {
+		t.Fatalf("expected %d bytes; got %d", length, len(got))
+	}
+}
@@ -0,0 +1,598 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// Routing modes.
+const (
+	routingBloom = "bloom"
+	routingDHT   = "dht"
+)
+
+const (
+	// dhtTimeout bounds each request made during a DHT lookup.
+	dhtTimeout = 5 * time.Second
+
+	// maxDHTConns is the maximum number of connections kept to nodes that
+	// aren't peers. The least recently used one is closed to make room.
+	maxDHTConns = 2 * kademliaK
+)
+
+// dhtConn is a cached connection to a node that isn't a peer.
+type dhtConn struct {
+	conn *grpc.ClientConn
+	used time.Time
+}
+
+func validateRouting(routing string) error {
+	switch routing {
+	case "", routingBloom, routingDHT:
+		return nil
+	default:
+		return errors.Errorf("unknown routing %q", routing)
+	}
+}
+
+// dhtMode returns whether lookups go through the Kademlia DHT instead of the
+// bloom filters of the connected peers.
+func (s *Server) dhtMode() bool {
+	return s.config.Routing == routingDHT
+}
+
+// dhtClient returns a client for a node, reusing the peer connection if there
+// is one. Connections to nodes that aren't peers are kept for later lookups,
+// up to maxDHTConns.
+func (s *Server) dhtClient(ctx context.Context, meta serverpb.NodeMeta) (serverpb.NodeClient, error) {
+	s.mu.Lock()
+	if client, ok := s.mu.peers[meta.Id]; ok {
+		s.mu.Unlock()
+		return client, nil
+	}
+	if cached, ok := s.mu.dhtConns[meta.Id]; ok {
+		cached.used = time.Now()
+		s.mu.Unlock()
+		return serverpb.NewNodeClient(cached.conn), nil
+	}
+	s.mu.Unlock()
+
+	conn, err := s.connectNode(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if existing, ok := s.mu.dhtConns[meta.Id]; ok {
+		// Another lookup connected first.
+		existing.used = time.Now()
+		s.mu.Unlock()
+		s.closeDHTConn(meta.Id, conn)
+		return serverpb.NewNodeClient(existing.conn), nil
+	}
+	if s.stopped() {
+		// The cached connections were already closed.
+		s.mu.Unlock()
+		s.closeDHTConn(meta.Id, conn)
+		return nil, ErrStopped
+	}
+	var evictedID string
+	var evicted *dhtConn
+	if len(s.mu.dhtConns) >= maxDHTConns {
+		for nodeID, cached := range s.mu.dhtConns {
+			if evicted == nil || cached.used.Before(evicted.used) {
+				evictedID, evicted = nodeID, cached
+			}
+		}
+		delete(s.mu.dhtConns, evictedID)
+	}
+	s.mu.dhtConns[meta.Id] = &dhtConn{conn: conn, used: time.Now()}
+	s.mu.Unlock()
+
+	if evicted != nil {
+		s.closeDHTConn(evictedID, evicted.conn)
+	}
+	return serverpb.NewNodeClient(conn), nil
+}
+
+func (s *Server) closeDHTConn(nodeID string, conn *grpc.ClientConn) {
+	if err := conn.Close(); err != nil {
+		s.log.Printf("failed to close connection: %s: %+v", color.RedString(nodeID), err)
+	}
+}
+
+// dhtRemove forgets a node that failed to respond.
+func (s *Server) dhtRemove(nodeID string) {
+	s.kb.Remove(nodeID)
+
+	s.mu.Lock()
+	cached, ok := s.mu.dhtConns[nodeID]
+	delete(s.mu.dhtConns, nodeID)
+	s.mu.Unlock()
+
+	if ok {
+		s.closeDHTConn(nodeID, cached.conn)
+	}
+}
+
+// dhtSeen validates the sender of a DHT request and adds it to the k-buckets.
+func (s *Server) dhtSeen(sender *serverpb.NodeMeta) error {
+	if sender == nil {
+		return errors.New("missing sender")
+	}
+	if err := validateNodeMeta(*sender); err != nil {
+		return err
+	}
+	return s.dhtUpdate(*sender)
+}
+
+// dhtUpdate records that a node was seen. If its bucket is full the least
+// recently seen node of the bucket is pinged and replaced by the new node if
+// it doesn't respond, so long-lived nodes are preferred.
+func (s *Server) dhtUpdate(meta serverpb.NodeMeta) error {
+	oldest, err := s.kb.Update(meta)
+	if err != nil || oldest == nil {
+		return err
+	}
+	go func() {
+		ctx, cancel := s.stopContext()
+		defer cancel()
+		ctx, cancel = context.WithTimeout(ctx, dhtTimeout)
+		defer cancel()
+		client, err := s.dhtClient(ctx, *oldest)
+		if err == nil {
+			_, err = client.HeartBeat(ctx, &serverpb.HeartBeatRequest{})
+		}
+		if err == nil {
+			if _, err := s.kb.Update(*oldest); err != nil {
+				s.log.Printf("failed to update k-buckets: %+v", err)
+			}
+			return
+		}
+		if s.stopped() {
+			return
+		}
+		s.dhtRemove(oldest.Id)
+		if err := s.kb.Evict(oldest.Id, meta); err != nil {
+			s.log.Printf("failed to update k-buckets: %+v", err)
+		}
+	}()
+	return nil
+}
+
+// dhtQuery sends a request to a node during a lookup. It returns the nodes
+// closer to the key the node knows and whether the lookup is done.
+type dhtQuery func(ctx context.Context, client serverpb.NodeClient, sender *serverpb.NodeMeta) ([]*serverpb.NodeMeta, bool, error)
+
+// dhtLookup iteratively queries the nodes closest to key, kademliaAlpha at a
+// time, until the kademliaK closest nodes found have all responded or query
+// reports that the lookup is done. It returns the closest nodes that
+// responded.
+func (s *Server) dhtLookup(ctx context.Context, key kademliaKey, query dhtQuery) ([]serverpb.NodeMeta, error) {
+	sender, err := s.NodeMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	shortlist := s.kb.Closest(key, kademliaK)
+	seen := map[string]bool{s.id: true}
+	for _, meta := range shortlist {
+		seen[meta.Id] = true
+	}
+	queried := map[string]bool{}
+	failed := map[string]bool{}
+
+	for {
+		var batch []serverpb.NodeMeta
+		for _, meta := range shortlist {
+			if len(batch) == kademliaAlpha {
+				break
+			}
+			if !queried[meta.Id] {
+				batch = append(batch, meta)
+				queried[meta.Id] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var mu sync.Mutex
+		var found []*serverpb.NodeMeta
+		var done bool
+		var wg sync.WaitGroup
+		for _, meta := range batch {
+			meta := meta
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				ctx, cancel := context.WithTimeout(ctx, dhtTimeout)
+				defer cancel()
+				client, err := s.dhtClient(ctx, meta)
+				var nodes []*serverpb.NodeMeta
+				var nodeDone bool
+				if err == nil {
+					nodes, nodeDone, err = query(ctx, client, &sender)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					s.log.Printf("dht query to %s failed: %+v", color.RedString(meta.Id), err)
+					failed[meta.Id] = true
+					return
+				}
+				found = append(found, nodes...)
+				done = done || nodeDone
+			}()
+		}
+		wg.Wait()
+
+		for id := range failed {
+			s.dhtRemove(id)
+		}
+		if done {
+			break
+		}
+		for _, meta := range found {
+			if seen[meta.Id] {
+				continue
+			}
+			if err := validateNodeMeta(*meta); err != nil {
+				continue
+			}
+			seen[meta.Id] = true
+			shortlist = append(shortlist, *meta)
+			if err := s.dhtUpdate(*meta); err != nil {
+				return nil, err
+			}
+		}
+
+		var alive []serverpb.NodeMeta
+		for _, meta := range shortlist {
+			if !failed[meta.Id] {
+				alive = append(alive, meta)
+			}
+		}
+		shortlist = alive
+		sortByDistance(shortlist, key)
+		if len(shortlist) > kademliaK {
+			shortlist = shortlist[:kademliaK]
+		}
+	}
+
+	var closest []serverpb.NodeMeta
+	for _, meta := range shortlist {
+		if queried[meta.Id] && !failed[meta.Id] {
+			closest = append(closest, meta)
+		}
+	}
+	return closest, nil
+}
+
+// dhtFindNodes returns the nodes closest to key.
+func (s *Server) dhtFindNodes(ctx context.Context, key kademliaKey) ([]serverpb.NodeMeta, error) {
+	return s.dhtLookup(ctx, key, func(ctx context.Context, client serverpb.NodeClient, sender *serverpb.NodeMeta) ([]*serverpb.NodeMeta, bool, error) {
+		resp, err := client.FindNode(ctx, &serverpb.FindNodeRequest{
+			Sender: sender,
+			Key:    key[:],
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		return resp.Nodes, false, nil
+	})
+}
+
+// dhtBootstrap populates the k-buckets by looking up the local node. It does
+// nothing if a bootstrap is already running and stops when the server is
+// closed.
+func (s *Server) dhtBootstrap() {
+	s.mu.Lock()
+	if s.mu.dhtBootstrapping {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.dhtBootstrapping = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.mu.dhtBootstrapping = false
+		s.mu.Unlock()
+	}()
+
+	ctx, cancel := s.stopContext()
+	defer cancel()
+	key, err := nodeKey(s.id)
+	if err != nil {
+		s.log.Printf("dht bootstrap error: %+v", err)
+		return
+	}
+	if _, err := s.dhtFindNodes(ctx, key); err != nil {
+		s.log.Printf("dht bootstrap error: %+v", err)
+	}
+}
+
+// dhtFindProviders looks up the providers of a document.
+func (s *Server) dhtFindProviders(ctx context.Context, id string) ([]*serverpb.NodeMeta, error) {
+	var mu sync.Mutex
+	var providers []*serverpb.NodeMeta
+	if _, err := s.dhtLookup(ctx, valueKey(id), func(ctx context.Context, client serverpb.NodeClient, sender *serverpb.NodeMeta) ([]*serverpb.NodeMeta, bool, error) {
+		resp, err := client.FindValue(ctx, &serverpb.FindValueRequest{
+			Sender:     sender,
+			DocumentId: id,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		var valid []*serverpb.NodeMeta
+		for _, meta := range resp.Providers {
+			if err := validateNodeMeta(*meta); err == nil {
+				valid = append(valid, meta)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		providers = append(providers, valid...)
+		return resp.Nodes, len(valid) > 0, nil
+	}); err != nil {
+		return nil, err
+	}
+	return providers, nil
+}
+
+// dhtGetReference looks up a reference, returning nil if it isn't found.
+func (s *Server) dhtGetReference(ctx context.Context, id string) (*serverpb.Reference, error) {
+	var mu sync.Mutex
+	var reference *serverpb.Reference
+	if _, err := s.dhtLookup(ctx, valueKey(id), func(ctx context.Context, client serverpb.NodeClient, sender *serverpb.NodeMeta) ([]*serverpb.NodeMeta, bool, error) {
+		resp, err := client.FindValue(ctx, &serverpb.FindValueRequest{
+			Sender:      sender,
+			ReferenceId: id,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if resp.Reference == nil {
+			return resp.Nodes, false, nil
+		}
+		if err := verifyReference(id, *resp.Reference); err != nil {
+			s.log.Printf("dht returned invalid reference: %+v", err)
+			return resp.Nodes, false, nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if reference == nil || newerReference(*resp.Reference, *reference) {
+			reference = resp.Reference
+		}
+		return resp.Nodes, true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return reference, nil
+}
+
+// dhtStore stores a record on the nodes closest to key.
+func (s *Server) dhtStore(ctx context.Context, key kademliaKey, req *serverpb.StoreRequest) error {
+	nodes, err := s.dhtFindNodes(ctx, key)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, meta := range nodes {
+		wg.Add(1)
+		go func(meta serverpb.NodeMeta) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, dhtTimeout)
+			defer cancel()
+			client, err := s.dhtClient(ctx, meta)
+			if err == nil {
+				_, err = client.Store(ctx, req)
+			}
+			if err != nil {
+				s.log.Printf("dht store on %s failed: %+v", color.RedString(meta.Id), err)
+			}
+		}(meta)
+	}
+	wg.Wait()
+	return nil
+}
+
+// dhtProvide stores provider records for the pinned documents among ids on
+// the nodes closest to each of them, a few documents at a time. Documents
+// linked from a pin aren't announced; nodes fetching them ask the providers of
+// the document linking them, see fetchDocumentDHT.
+func (s *Server) dhtProvide(ctx context.Context, ids []string) error {
+	s.gcMu.RLock()
+	if s.stopped() {
+		s.gcMu.RUnlock()
+		return nil
+	}
+	pins, err := s.pins()
+	s.gcMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	pinned := map[string]bool{}
+	for _, pin := range pins {
+		pinned[pin.DocumentId] = true
+	}
+
+	meta, err := s.NodeMeta()
+	if err != nil {
+		return err
+	}
+	sem := make(chan struct{}, kademliaAlpha)
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		if !pinned[id] {
+			continue
+		}
+		// Only provide each document once.
+		delete(pinned, id)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := s.dhtStore(ctx, valueKey(id), &serverpb.StoreRequest{
+				Sender:   &meta,
+				Provided: []string{id},
+			}); err != nil {
+				s.log.Printf("failed to provide %s: %+v", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+	return nil
+}
+
+// dhtPutReference stores a reference on the nodes closest to its ID.
+func (s *Server) dhtPutReference(ctx context.Context, id string, reference serverpb.Reference) error {
+	meta, err := s.NodeMeta()
+	if err != nil {
+		return err
+	}
+	return s.dhtStore(ctx, valueKey(id), &serverpb.StoreRequest{
+		Sender:    &meta,
+		Reference: &reference,
+	})
+}
+
+// fetchDocumentDHT fetches a document from one of its providers. The
+// providers of a document are assumed to store everything linked from it, so
+// they are recorded as providers of the linked documents, which aren't
+// announced themselves.
+func (s *Server) fetchDocumentDHT(ctx context.Context, id string) ([]byte, error) {
+	providers, err := s.localProviders(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(providers) == 0 {
+		providers, err = s.dhtFindProviders(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, meta := range providers {
+		if meta.Id == s.id {
+			continue
+		}
+		client, err := s.dhtClient(ctx, *meta)
+		if err != nil {
+			continue
+		}
+		// A TTL of 0 keeps the provider from forwarding the request.
+		resp, err := client.GetDocument(ctx, &serverpb.GetDocumentRequest{
+			DocumentId: id,
+			Visited:    []string{s.id},
+		})
+		if err != nil {
+			continue
+		}
+		if err := verifyID(id, resp.Document); err != nil {
+			s.log.Printf("provider %s returned invalid document: %+v", color.RedString(meta.Id), err)
+			continue
+		}
+		var doc serverpb.Document
+		if err := doc.Unmarshal(resp.Document); err == nil {
+			s.addProviders(*meta, documentLinks(doc), time.Now().Add(providerTTL))
+		}
+		if err := s.putFetched(id, resp.Document); err != nil {
+			return nil, err
+		}
+		return resp.Document, nil
+	}
+	return nil, ErrDocumentNotFound
+}
+
+// closeDHTConns closes the connections to nodes that aren't peers.
+func (s *Server) closeDHTConns() {
+	s.mu.Lock()
+	conns := s.mu.dhtConns
+	s.mu.dhtConns = map[string]*dhtConn{}
+	s.mu.Unlock()
+
+	for nodeID, cached := range conns {
+		s.closeDHTConn(nodeID, cached.conn)
+	}
+}
+
+// FindNode returns the nodes closest to a key.
+func (s *Server) FindNode(ctx context.Context, in *serverpb.FindNodeRequest) (*serverpb.FindNodeResponse, error) {
+	if err := s.dhtSeen(in.Sender); err != nil {
+		return nil, err
+	}
+	var key kademliaKey
+	if len(in.Key) != len(key) {
+		return nil, errors.Errorf("expected %d byte key; got %d", len(key), len(in.Key))
+	}
+	copy(key[:], in.Key)
+
+	resp := &serverpb.FindNodeResponse{}
+	for _, meta := range s.kb.Closest(key, kademliaK) {
+		meta := meta
+		resp.Nodes = append(resp.Nodes, &meta)
+	}
+	return resp, nil
+}
+
+// FindValue returns the providers of a document or a reference stored on this
+// node, along with the closest nodes to its key.
+func (s *Server) FindValue(ctx context.Context, in *serverpb.FindValueRequest) (*serverpb.FindValueResponse, error) {
+	if err := s.dhtSeen(in.Sender); err != nil {
+		return nil, err
+	}
+
+	resp := &serverpb.FindValueResponse{}
+	var key kademliaKey
+	switch {
+	case in.DocumentId != "":
+		key = valueKey(in.DocumentId)
+		providers, err := s.localProviders(in.DocumentId)
+		if err != nil {
+			return nil, err
+		}
+		resp.Providers = providers
+	case in.ReferenceId != "":
+		key = valueKey(in.ReferenceId)
+		s.mu.Lock()
+		if reference, ok := s.mu.references[in.ReferenceId]; ok {
+			resp.Reference = &reference
+		}
+		s.mu.Unlock()
+	default:
+		return nil, errors.New("missing document or reference ID")
+	}
+
+	for _, meta := range s.kb.Closest(key, kademliaK) {
+		meta := meta
+		resp.Nodes = append(resp.Nodes, &meta)
+	}
+	return resp, nil
+}
+
+// Store keeps provider records for the sender and references.
+func (s *Server) Store(ctx context.Context, in *serverpb.StoreRequest) (*serverpb.StoreResponse, error) {
+	if err := s.dhtSeen(in.Sender); err != nil {
+		return nil, err
+	}
+	if len(in.Provided) > 0 {
+		s.addProviders(*in.Sender, in.Provided, time.Now().Add(providerTTL))
+	}
+	if in.Reference != nil {
+		if _, err := s.storeReference(*in.Reference); err != nil {
+			return nil, err
+		}
+	}
+	return &serverpb.StoreResponse{}, nil
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+const (
+	// documentTTL is the maximum number of hops a document lookup is
+	// forwarded through the network.
+	documentTTL = 5
+)
+
+var ErrDocumentNotFound = errors.New("document not found")
+
+func documentKey(id string) []byte {
+	return []byte(fmt.Sprintf("/document/%s", id))
+}
+
+// hashDocument returns the ID of a marshalled document using the configured
+// hash function.
+func (s *Server) hashDocument(body []byte) string {
+	// The hash function is validated by New so this can't fail.
+	d, _ := digest(s.hashFunc, body)
+	return encodeID(s.hashFunc, d)
+}
+
+// localDocument returns the marshalled document with the specified ID from the
+// local store. It returns badger.ErrKeyNotFound if the document isn't stored
+// on this node.
+func (s *Server) localDocument(id string) ([]byte, error) {
+	var body []byte
+	if err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(documentKey(id))
+		if err != nil {
+			return err
+		}
+		body, err = item.ValueCopy(nil)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return decompressDocument(body)
+}
+
+// putDocument stores a marshalled document under the specified ID, compressed
+// with the configured codec. Bodies that aren't marshalled documents are
+// rejected since they could be read back as compressed, see compression.go.
+func (s *Server) putDocument(id string, body []byte) error {
+	if len(body) > 0 && body[0] == compressionMarker {
+		return errors.Errorf("document %s starts with the compression marker", id)
+	}
+	var doc serverpb.Document
+	if err := doc.Unmarshal(body); err != nil {
+		return errors.Wrapf(err, "document %s", id)
+	}
+	stored := compressDocument(s.codec, body)
+	var exists bool
+	for {
+		exists = false
+		err := s.db.Update(func(txn *badger.Txn) error {
+			_, err := txn.Get(documentKey(id))
+			if err == nil {
+				exists = true
+				return nil
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			if err := txn.Set(documentKey(id), stored); err != nil {
+				return err
+			}
+			return setDocumentStat(txn, id, serverpb.DocumentStat{
+				Length:     int64(len(stored)),
+				LastAccess: time.Now().UnixNano(),
+			})
+		})
+		// A concurrent store of the same document conflicts; retry to find
+		// it stored.
+		if err == badger.ErrConflict {
+			continue
+		} else if err != nil {
+			return err
+		}
+		break
+	}
+	if !exists {
+		s.rt.AddLocal(id)
+		s.updateStorageUsage(int64(len(stored)), 1)
+		s.queueAnnounce(id)
+		s.sendWanted(id, body)
+	}
+	return nil
+}
+
+// putFetched stores a document received from the network. gcMu is held so
+// garbage collection either runs before the document is stored or finds it
+// along with the pinned documents linking to it, which are fetched first.
+func (s *Server) putFetched(id string, body []byte) error {
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	if s.stopped() {
+		return ErrStopped
+	}
+	return s.putDocument(id, body)
+}
+
+// deleteDocument removes a document from the local store and from the bloom
+// filter advertised to peers.
+func (s *Server) deleteDocument(id string) error {
+	var exists bool
+	var stat serverpb.DocumentStat
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(documentKey(id))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		exists = true
+		stat, err = getDocumentStat(txn, id)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err := txn.Delete(documentStatKey(id)); err != nil {
+			return err
+		}
+		return txn.Delete(documentKey(id))
+	}); err != nil {
+		return err
+	}
+	if exists {
+		s.rt.RemoveLocal(id)
+		s.updateStorageUsage(-stat.Length, -1)
+	}
+	return nil
+}
+
+// getDocumentBody returns the marshalled document with the specified ID. If
+// the document isn't stored locally it is fetched from the network and cached.
+func (s *Server) getDocumentBody(ctx context.Context, id string) ([]byte, error) {
+	body, err := s.localDocument(id)
+	if err == nil {
+		s.touchDocument(id)
+	} else if err == badger.ErrKeyNotFound {
+		body, err = s.fetchDocument(ctx, id, nil, documentTTL, newRequestID())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// getDocument returns the document with the specified ID. If the document
+// isn't stored locally it is fetched from the network and cached.
+func (s *Server) getDocument(ctx context.Context, id string) (serverpb.Document, error) {
+	var doc serverpb.Document
+	body, err := s.getDocumentBody(ctx, id)
+	if err != nil {
+		return serverpb.Document{}, err
+	}
+	if err := doc.Unmarshal(body); err != nil {
+		return serverpb.Document{}, err
+	}
+	return doc, nil
+}
+
+// fetchDocument asks the connected peers that haven't been visited yet for a
+// document in the order given by the routing table. The first response that
+// hashes to the requested ID is cached locally and returned. Lookups already
+// forwarded by this node under the same request ID aren't forwarded again.
+func (s *Server) fetchDocument(ctx context.Context, id string, visited []string, ttl int32, requestID string) ([]byte, error) {
+	if ttl <= 0 || !s.requests.firstSeen(requestID, time.Now()) {
+		return nil, ErrDocumentNotFound
+	}
+	if s.dhtMode() {
+		return s.fetchDocumentDHT(ctx, id)
+	}
+
+	req := &serverpb.GetDocumentRequest{
+		DocumentId: id,
+		Visited:    append(append([]string{}, visited...), s.id),
+		Ttl:        ttl - 1,
+		RequestId:  requestID,
+	}
+	for _, peerID := range s.routePeers(id, visited) {
+		s.mu.Lock()
+		client, ok := s.mu.peers[peerID]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		resp, err := client.GetDocument(ctx, req)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if err := verifyID(id, resp.Document); err != nil {
+			s.log.Printf("peer %s returned invalid document: %+v", color.RedString(peerID), err)
+			continue
+		}
+		if err := s.putFetched(id, resp.Document); err != nil {
+			return nil, err
+		}
+		return resp.Document, nil
+	}
+	return nil, ErrDocumentNotFound
+}
+
+// GetDocument returns a document to a peer, forwarding the request to our own
+// peers if it isn't stored locally.
+func (s *Server) GetDocument(ctx context.Context, req *serverpb.GetDocumentRequest) (*serverpb.GetDocumentResponse, error) {
+	body, err := s.localDocument(req.DocumentId)
+	if err == nil {
+		s.touchDocument(req.DocumentId)
+	} else if err == badger.ErrKeyNotFound {
+		body, err = s.fetchDocument(ctx, req.DocumentId, req.Visited, req.Ttl, req.RequestId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.GetDocumentResponse{
+		Document: body,
+	}, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func newTestServer(t *testing.T, opts ...func(*serverpb.NodeConfig)) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := serverpb.NodeConfig{
+		Path: dir,
+	}
+	for _, f := range opts {
+		f(&c)
+	}
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDeleteDocumentUpdatesFilter(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	doc := serverpb.Document{Data: []byte("hello")}
+	body, err := doc.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := s.hashDocument(body)
+
+	// Storing the same document twice must only count it once.
+	for i := 0; i < 2; i++ {
+		if err := s.putDocument(id, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.rt.Filters("")[0].Check([]byte(id)) {
+		t.Fatal("expected local filter to contain document")
+	}
+
+	if err := s.deleteDocument(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.localDocument(id); err != badger.ErrKeyNotFound {
+		t.Fatalf("expected document to be deleted; got %v", err)
+	}
+	if s.rt.Filters("")[0].Check([]byte(id)) {
+		t.Fatal("expected local filter to no longer contain document")
+	}
+}
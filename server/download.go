@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+const (
+	// prefetchWindow is the maximum number of blocks fetched ahead of the
+	// block being read. Fetched blocks are held in memory until read.
+	prefetchWindow = 16
+
+	// downloadMaxWindow is the maximum number of blocks requested from a
+	// single peer at once.
+	downloadMaxWindow = 8
+
+	// downloadMaxFailures is the number of consecutive failed requests after
+	// which a peer isn't asked for more blocks.
+	downloadMaxFailures = 3
+
+	// blockTimeout bounds a single block request.
+	blockTimeout = 10 * time.Second
+
+	// progressInterval is the minimum time between progress reports.
+	progressInterval = 100 * time.Millisecond
+)
+
+// downloadPeer tracks a peer blocks are downloaded from.
+type downloadPeer struct {
+	sess *exchangeSession
+
+	window   int // blocks requested at once
+	inflight int
+	failures int // consecutive failed requests
+	bytes    int64
+	start    time.Time // time of the first request
+}
+
+// throughput returns the bytes per second received from the peer.
+func (p *downloadPeer) throughput(now time.Time) float64 {
+	elapsed := now.Sub(p.start).Seconds()
+	if p.start.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return float64(p.bytes) / elapsed
+}
+
+type blockResult struct {
+	peer  *downloadPeer
+	index int
+	body  []byte
+	err   error
+}
+
+// rangeBlocks returns the IDs of the blocks of a file holding length bytes
+// starting at offset. A length of 0 reads to the end of the file.
+func rangeBlocks(doc serverpb.Document, offset, length int64) []string {
+	var ids []string
+	var start int64
+	for _, link := range doc.Blocks {
+		end := start + link.Length
+		if end > offset && (length == 0 || start < offset+length) {
+			ids = append(ids, link.Id)
+		}
+		start = end
+	}
+	return ids
+}
+
+// downloader hands out the blocks of a file in order while fetching the
+// blocks after them that aren't stored locally from the connected peers in
+// parallel over block exchange. Each peer is asked for up to its window of
+// blocks at once. The window grows while the peer is at least as fast as the
+// average and is halved when a request fails; failed blocks are retried on
+// other peers. Blocks no peer sends are left for routed lookups.
+type downloader struct {
+	s        *Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+	ids      []string
+	key      []byte
+	progress func(serverpb.DownloadProgress) error
+
+	peers    []*downloadPeer
+	results  chan blockResult
+	inflight int
+	bodies   map[int][]byte          // blocks fetched but not read yet
+	pending  []int                   // blocks to request, in order
+	tried    map[int]map[string]bool // peers each block failed on
+	queued   int                     // index of the next block to queue
+	read     int                     // index of the next block to read
+
+	report     serverpb.DownloadProgress
+	remote     bool // whether any block was fetched from the network
+	start      time.Time
+	lastReport time.Time
+}
+
+// newDownloader returns a downloader for the blocks with the specified IDs,
+// decrypted with key if it isn't nil. progress is called as blocks are fetched
+// from the network. The downloader must be closed.
+func (s *Server) newDownloader(ctx context.Context, ids []string, key []byte, progress func(serverpb.DownloadProgress) error) *downloader {
+	ctx, cancel := context.WithCancel(ctx)
+	d := &downloader{
+		s:        s,
+		ctx:      ctx,
+		cancel:   cancel,
+		ids:      ids,
+		key:      key,
+		progress: progress,
+		bodies:   map[int][]byte{},
+		tried:    map[int]map[string]bool{},
+		start:    time.Now(),
+	}
+	d.report.BlocksTotal = int32(len(ids))
+	return d
+}
+
+// close cancels the requests still running.
+func (d *downloader) close() {
+	d.cancel()
+}
+
+// next returns the next block, which must have the specified ID.
+func (d *downloader) next(id string) (serverpb.Document, error) {
+	if d.read >= len(d.ids) || d.ids[d.read] != id {
+		return serverpb.Document{}, errors.Errorf("unexpected block %s", id)
+	}
+	body, err := d.wait()
+	if err != nil {
+		return serverpb.Document{}, err
+	}
+	delete(d.bodies, d.read)
+	d.read++
+	if d.remote && d.read == len(d.ids) {
+		if err := d.sendProgress(true); err != nil {
+			return serverpb.Document{}, err
+		}
+	}
+
+	var doc serverpb.Document
+	if err := doc.Unmarshal(body); err != nil {
+		return serverpb.Document{}, err
+	}
+	if d.key == nil {
+		return doc, nil
+	}
+	return decryptDocument(d.key, doc)
+}
+
+// wait returns the body of the block being read once it is available.
+func (d *downloader) wait() ([]byte, error) {
+	for {
+		if err := d.queue(); err != nil {
+			return nil, err
+		}
+		// Keep the peers busy with the blocks ahead even if the block being
+		// read is available.
+		d.dispatch()
+		if body, ok := d.bodies[d.read]; ok {
+			return body, nil
+		}
+		if d.inflight == 0 {
+			// No peer can send the block being read.
+			return d.fetchRouted()
+		}
+
+		var r blockResult
+		select {
+		case r = <-d.results:
+		case <-d.ctx.Done():
+			return nil, d.ctx.Err()
+		}
+		if err := d.receive(r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// queue reads the local blocks within the prefetch window and queues the
+// others to be requested.
+func (d *downloader) queue() error {
+	for d.queued < len(d.ids) && d.queued < d.read+prefetchWindow {
+		i := d.queued
+		d.queued++
+		body, err := d.s.localDocument(d.ids[i])
+		if err == badger.ErrKeyNotFound {
+			d.pending = append(d.pending, i)
+			continue
+		} else if err != nil {
+			return err
+		}
+		d.s.touchDocument(d.ids[i])
+		d.bodies[i] = body
+		d.report.BlocksDone++
+	}
+	return nil
+}
+
+// dispatch requests pending blocks from the peers with room in their window,
+// faster peers first.
+func (d *downloader) dispatch() {
+	if len(d.pending) == 0 {
+		return
+	}
+	if d.peers == nil {
+		for _, sess := range d.s.exchangeSessions() {
+			d.peers = append(d.peers, &downloadPeer{sess: sess, window: 1})
+		}
+		sort.Slice(d.peers, func(i, j int) bool { return d.peers[i].sess.nodeID < d.peers[j].sess.nodeID })
+		d.results = make(chan blockResult, len(d.peers)*downloadMaxWindow)
+	}
+
+	now := time.Now()
+	sort.SliceStable(d.peers, func(i, j int) bool {
+		return d.peers[i].throughput(now) > d.peers[j].throughput(now)
+	})
+	for _, p := range d.peers {
+		for p.failures < downloadMaxFailures && p.inflight < p.window {
+			j := d.nextPending(p)
+			if j < 0 {
+				break
+			}
+			i := d.pending[j]
+			d.pending = append(d.pending[:j], d.pending[j+1:]...)
+			if p.start.IsZero() {
+				p.start = now
+			}
+			p.inflight++
+			d.inflight++
+			go d.s.downloadBlock(d.ctx, p, i, d.ids[i], d.results)
+		}
+	}
+}
+
+// nextPending returns the index in pending of the first block that hasn't
+// failed on the peer, or -1 if there is none.
+func (d *downloader) nextPending(p *downloadPeer) int {
+	for j, i := range d.pending {
+		if !d.tried[i][p.sess.nodeID] {
+			return j
+		}
+	}
+	return -1
+}
+
+// receive handles the result of a block request.
+func (d *downloader) receive(r blockResult) error {
+	r.peer.inflight--
+	d.inflight--
+	if r.err != nil {
+		d.s.log.Printf("failed to download %s from %s: %+v", d.ids[r.index], color.RedString(r.peer.sess.nodeID), r.err)
+		if d.tried[r.index] == nil {
+			d.tried[r.index] = map[string]bool{}
+		}
+		d.tried[r.index][r.peer.sess.nodeID] = true
+		r.peer.failures++
+		if r.peer.window > 1 {
+			r.peer.window /= 2
+		}
+		d.pending = append(d.pending, r.index)
+		sort.Ints(d.pending)
+		return nil
+	}
+
+	r.peer.failures = 0
+	r.peer.bytes += int64(len(r.body))
+	now := time.Now()
+	if r.peer.window < downloadMaxWindow && r.peer.throughput(now) >= averageThroughput(d.peers, now) {
+		r.peer.window++
+	}
+	d.received(r.index, r.body)
+	return d.sendProgress(false)
+}
+
+// fetchRouted fetches the block being read with a routed lookup.
+func (d *downloader) fetchRouted() ([]byte, error) {
+	for j, i := range d.pending {
+		if i == d.read {
+			d.pending = append(d.pending[:j], d.pending[j+1:]...)
+			break
+		}
+	}
+	delete(d.tried, d.read)
+	body, err := d.s.getDocumentBody(d.ctx, d.ids[d.read])
+	if err != nil {
+		return nil, err
+	}
+	d.received(d.read, body)
+	return body, d.sendProgress(false)
+}
+
+// received records a block fetched from the network.
+func (d *downloader) received(i int, body []byte) {
+	d.bodies[i] = body
+	d.remote = true
+	d.report.BlocksDone++
+	d.report.Bytes += int64(len(body))
+}
+
+// sendProgress reports the progress at most every progressInterval unless
+// force is set.
+func (d *downloader) sendProgress(force bool) error {
+	now := time.Now()
+	if !force && now.Sub(d.lastReport) < progressInterval {
+		return nil
+	}
+	d.lastReport = now
+	if elapsed := now.Sub(d.start).Seconds(); elapsed > 0 {
+		d.report.BytesPerSecond = float64(d.report.Bytes) / elapsed
+	}
+	return d.progress(d.report)
+}
+
+// averageThroughput returns the mean throughput of the peers blocks were
+// requested from.
+func averageThroughput(peers []*downloadPeer, now time.Time) float64 {
+	var total float64
+	var n int
+	for _, p := range peers {
+		if !p.start.IsZero() {
+			total += p.throughput(now)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / float64(n)
+}
+
+// downloadBlock asks a single peer for a block over block exchange.
+func (s *Server) downloadBlock(ctx context.Context, p *downloadPeer, i int, id string, results chan<- blockResult) {
+	ctx, cancel := context.WithTimeout(ctx, blockTimeout)
+	defer cancel()
+	bodies, err := s.wantBlocks(ctx, []*exchangeSession{p.sess}, []string{id})
+	r := blockResult{peer: p, index: i, err: err}
+	if body, ok := bodies[id]; ok {
+		r.body = body
+	} else if err == nil {
+		r.err = errors.Errorf("%s wasn't sent", id)
+	}
+	results <- r
+}
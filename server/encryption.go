@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted documents are stored as a document with encryptedContentType whose
+// data is the marshalled plaintext document sealed with AES-256-GCM. The IDs
+// of the documents linked from the plaintext document are kept in the children
+// of the encrypted document so pinning, garbage collection and exports work
+// without the key.
+//
+// Every block of an encrypted file is encrypted with the same key. Children
+// of encrypted directories may be capabilities so a whole tree can be read
+// with the capability of its root.
+
+const (
+	encryptedContentType = "encrypted"
+	encryptionKeySize    = 32
+	capabilitySeparator  = ":"
+)
+
+// newEncryptionKey returns a random key to encrypt documents with.
+func newEncryptionKey() ([]byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// addKey returns the key to encrypt a document being added with, or nil if it
+// isn't encrypted. Capabilities may only be stored in encrypted documents
+// since they contain the key of the child.
+func addKey(encrypt bool, doc serverpb.Document) ([]byte, error) {
+	if encrypt {
+		return newEncryptionKey()
+	}
+	for name, child := range doc.Children {
+		if strings.Contains(child, capabilitySeparator) {
+			return nil, errors.Errorf("child %q is a capability: directories with encrypted children must be encrypted", name)
+		}
+	}
+	return nil, nil
+}
+
+// formatCapability returns the capability to read an encrypted document:
+// <id>:<key>.
+func formatCapability(id string, key []byte) string {
+	return id + capabilitySeparator + idEncoding.EncodeToString(key)
+}
+
+// parseCapability splits a capability into the document ID and key. IDs
+// without a key are returned with a nil key.
+func parseCapability(c string) (string, []byte, error) {
+	i := strings.Index(c, capabilitySeparator)
+	if i < 0 {
+		return c, nil, nil
+	}
+	key, err := idEncoding.DecodeString(c[i+len(capabilitySeparator):])
+	if err != nil || len(key) != encryptionKeySize {
+		// Don't echo the key, which may end up in logs.
+		return "", nil, errors.Errorf("invalid capability for %s", c[:i])
+	}
+	return c[:i], key, nil
+}
+
+// encryptDocument returns the encrypted form of doc.
+func encryptDocument(key []byte, doc serverpb.Document) (serverpb.Document, error) {
+	var links []string
+	for _, child := range doc.Children {
+		id, _, err := parseCapability(child)
+		if err != nil {
+			return serverpb.Document{}, err
+		}
+		links = append(links, id)
+	}
+	for _, link := range doc.Blocks {
+		links = append(links, link.Id)
+	}
+	sort.Strings(links)
+
+	body, err := doc.Marshal()
+	if err != nil {
+		return serverpb.Document{}, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return serverpb.Document{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return serverpb.Document{}, err
+	}
+
+	encrypted := serverpb.Document{
+		ContentType: encryptedContentType,
+		Data:        aead.Seal(nonce, nonce, body, nil),
+	}
+	if len(links) > 0 {
+		encrypted.Children = map[string]string{}
+		for i, id := range links {
+			encrypted.Children[strconv.Itoa(i)] = id
+		}
+	}
+	return encrypted, nil
+}
+
+// decryptDocument returns the plaintext document of an encrypted document.
+func decryptDocument(key []byte, doc serverpb.Document) (serverpb.Document, error) {
+	if doc.ContentType != encryptedContentType {
+		return serverpb.Document{}, errors.New("document isn't encrypted")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return serverpb.Document{}, err
+	}
+	if len(doc.Data) < aead.NonceSize() {
+		return serverpb.Document{}, errors.New("truncated encrypted document")
+	}
+	nonce, sealed := doc.Data[:aead.NonceSize()], doc.Data[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return serverpb.Document{}, errors.New("failed to decrypt document: wrong key")
+	}
+	var plain serverpb.Document
+	if err := plain.Unmarshal(body); err != nil {
+		return serverpb.Document{}, err
+	}
+	return plain, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
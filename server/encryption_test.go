@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedDocuments(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	data := make([]byte, 2*blockSize+100)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	file, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: data, ContentType: "application/pdf"},
+		Encrypt:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(file.Capability, file.DocumentId+capabilitySeparator) {
+		t.Fatalf("unexpected capability %q for %s", file.Capability, file.DocumentId)
+	}
+
+	// Capabilities can't be stored in plain directories.
+	if _, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			ContentType: "directory",
+			Children:    map[string]string{"secret.pdf": file.Capability},
+		},
+	}); err == nil {
+		t.Fatal("expected error adding capability to unencrypted directory")
+	}
+	dir, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			ContentType: "directory",
+			Children:    map[string]string{"secret.pdf": file.Capability},
+		},
+		Encrypt: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the key only the ciphertext and the links are visible.
+	raw, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: dir.DocumentId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Document.ContentType != encryptedContentType || len(raw.Document.Children) != 1 {
+		t.Fatalf("unexpected encrypted document %+v", raw.Document)
+	}
+	for name, id := range raw.Document.Children {
+		if name == "secret.pdf" || id != file.DocumentId {
+			t.Fatalf("unexpected encrypted child %s: %s", name, id)
+		}
+	}
+
+	got, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: dir.Capability + "/secret.pdf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DocumentId != file.Capability {
+		t.Fatalf("expected %s; got %s", file.Capability, got.DocumentId)
+	}
+	if got.Document.ContentType != "application/pdf" || !bytes.Equal(got.Document.Data, data) {
+		t.Fatal("decrypted document doesn't match")
+	}
+
+	ranged, err := s.Get(ctx, &serverpb.GetRequest{
+		DocumentId: file.Capability,
+		Offset:     blockSize - 10,
+		Length:     20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ranged.Document.Data, data[blockSize-10:blockSize+10]) {
+		t.Fatal("decrypted range doesn't match")
+	}
+
+	// Garbage collection follows the links of encrypted documents.
+	if _, err := s.Unpin(ctx, &serverpb.UnpinRequest{DocumentId: file.DocumentId}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GarbageCollect(ctx, &serverpb.GarbageCollectRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: file.Capability}); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey := formatCapability(file.DocumentId, make([]byte, encryptionKeySize))
+	if _, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: wrongKey}); err == nil {
+		t.Fatal("expected error decrypting with the wrong key")
+	}
+}
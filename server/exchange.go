@@ -0,0 +1,479 @@
+package server
+
+import (
+	"context"
+	"io"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+)
+
+// Block exchange fetches many documents from every peer at once. A node opens
+// a long-lived Exchange stream to each of its peers and sends want lists over
+// it. Peers respond with the documents they store and say which ones they
+// don't have, remembering those so they can be sent if they arrive later. As
+// soon as a wanted document is received the want is cancelled on every
+// stream.
+
+const (
+	// exchangeBatchSize is the maximum number of IDs sent in a single want
+	// list or cancel.
+	exchangeBatchSize = 1024
+
+	// exchangeBuffer is the number of messages queued for each stream.
+	exchangeBuffer = 64
+
+	// wantTimeout bounds how long wanted documents are waited for before
+	// falling back to routed lookups.
+	wantTimeout = 10 * time.Second
+
+	// maxSessionWants is the maximum number of documents a peer may want
+	// that aren't stored locally. Wants past it are answered with dont_have
+	// but not remembered.
+	maxSessionWants = 4096
+)
+
+// exchangeStream is implemented by both ends of an Exchange stream.
+type exchangeStream interface {
+	Send(*serverpb.ExchangeMessage) error
+	Recv() (*serverpb.ExchangeMessage, error)
+}
+
+// exchangeSession is one end of an Exchange stream.
+type exchangeSession struct {
+	nodeID string // peer the stream was opened to; empty for inbound streams
+	out    chan *serverpb.ExchangeMessage
+	// wantC queues the want lists received for serveWants so the receiving
+	// goroutine never waits for room on out.
+	wantC chan []string
+	done  chan struct{}
+
+	mu sync.Mutex
+	// wants holds the IDs the peer wants that aren't stored locally yet.
+	wants map[string]bool
+}
+
+func newExchangeSession(nodeID string) *exchangeSession {
+	return &exchangeSession{
+		nodeID: nodeID,
+		out:    make(chan *serverpb.ExchangeMessage, exchangeBuffer),
+		wantC:  make(chan []string, exchangeBuffer),
+		done:   make(chan struct{}),
+		wants:  map[string]bool{},
+	}
+}
+
+// send queues a message unless the stream is closed.
+func (sess *exchangeSession) send(msg *serverpb.ExchangeMessage) {
+	select {
+	case sess.out <- msg:
+	case <-sess.done:
+	}
+}
+
+// trySend queues a message if there is room and reports whether it was
+// queued.
+func (sess *exchangeSession) trySend(msg *serverpb.ExchangeMessage) bool {
+	select {
+	case sess.out <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendBatches sends ids in batches of at most exchangeBatchSize using msg to
+// build each message.
+func (sess *exchangeSession) sendBatches(ids []string, msg func([]string) *serverpb.ExchangeMessage) {
+	for i := 0; i < len(ids); i += exchangeBatchSize {
+		end := i + exchangeBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		sess.send(msg(ids[i:end]))
+	}
+}
+
+// want is a document being fetched over block exchange, shared by every
+// fetch waiting for it.
+type want struct {
+	refs     int
+	body     []byte
+	received chan struct{} // closed once body is set
+	missing  chan struct{} // closed once every session asked doesn't have it
+	asked    map[*exchangeSession]bool
+}
+
+// markAsked removes sess from the sessions that may still send the document.
+func (w *want) markAsked(sess *exchangeSession) {
+	if !w.asked[sess] {
+		return
+	}
+	delete(w.asked, sess)
+	if len(w.asked) > 0 {
+		return
+	}
+	select {
+	case <-w.missing:
+	default:
+		close(w.missing)
+	}
+}
+
+// runExchange handles the messages received on a stream until it is closed.
+// Receiving never waits for messages to be sent: if both ends waited for room
+// on their streams while neither read, the exchange would deadlock. Wants are
+// served by a separate goroutine and answered with dont_have when too many are
+// queued.
+func (s *Server) runExchange(sess *exchangeSession, stream exchangeStream) error {
+	s.mu.Lock()
+	s.mu.exchanges[sess] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.mu.exchanges, sess)
+		if s.mu.exchangePeers[sess.nodeID] == sess {
+			delete(s.mu.exchangePeers, sess.nodeID)
+		}
+		for _, w := range s.mu.wants {
+			w.markAsked(sess)
+		}
+		s.mu.Unlock()
+		close(sess.done)
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-sess.done:
+				return
+			case msg := <-sess.out:
+				if err := stream.Send(msg); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-sess.done:
+				return
+			case ids := <-sess.wantC:
+				s.serveWants(sess, ids)
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if len(msg.Cancel) > 0 {
+			sess.mu.Lock()
+			for _, id := range msg.Cancel {
+				delete(sess.wants, id)
+			}
+			sess.mu.Unlock()
+		}
+		if len(msg.Want) > 0 {
+			select {
+			case sess.wantC <- msg.Want:
+			default:
+				if !sess.trySend(&serverpb.ExchangeMessage{DontHave: msg.Want}) {
+					s.log.Printf("exchange with %s is backed up; dropping %d wants", color.RedString(sess.nodeID), len(msg.Want))
+				}
+			}
+		}
+		for _, block := range msg.Blocks {
+			s.receiveBlock(sess, block)
+		}
+		if len(msg.DontHave) > 0 {
+			s.mu.Lock()
+			for _, id := range msg.DontHave {
+				if w, ok := s.mu.wants[id]; ok {
+					w.markAsked(sess)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// serveWants sends the wanted documents stored locally and remembers the
+// others in case they arrive later.
+func (s *Server) serveWants(sess *exchangeSession, ids []string) {
+	var blocks []*serverpb.ExchangeBlock
+	var dontHave []string
+	s.gcMu.RLock()
+	if s.stopped() {
+		s.gcMu.RUnlock()
+		return
+	}
+	for _, id := range ids {
+		body, err := s.localDocument(id)
+		if err == badger.ErrKeyNotFound {
+			dontHave = append(dontHave, id)
+			continue
+		} else if err != nil {
+			s.log.Printf("failed to read wanted document %s: %+v", id, err)
+			continue
+		}
+		s.touchDocument(id)
+		blocks = append(blocks, &serverpb.ExchangeBlock{Id: id, Data: body})
+	}
+	s.gcMu.RUnlock()
+
+	sess.mu.Lock()
+	for _, id := range dontHave {
+		if len(sess.wants) >= maxSessionWants {
+			break
+		}
+		sess.wants[id] = true
+	}
+	sess.mu.Unlock()
+
+	for _, block := range blocks {
+		sess.send(&serverpb.ExchangeMessage{
+			Blocks: []*serverpb.ExchangeBlock{block},
+		})
+	}
+	sess.sendBatches(dontHave, func(ids []string) *serverpb.ExchangeMessage {
+		return &serverpb.ExchangeMessage{DontHave: ids}
+	})
+}
+
+// sendWanted sends a newly stored document to the peers that want it. It is
+// called while storing documents so it doesn't wait for room on the streams;
+// peers whose streams are backed up fall back to routed lookups.
+func (s *Server) sendWanted(id string, body []byte) {
+	s.mu.Lock()
+	var sessions []*exchangeSession
+	for sess := range s.mu.exchanges {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.mu.Lock()
+		wanted := sess.wants[id]
+		delete(sess.wants, id)
+		sess.mu.Unlock()
+		if !wanted {
+			continue
+		}
+		if !sess.trySend(&serverpb.ExchangeMessage{
+			Blocks: []*serverpb.ExchangeBlock{{Id: id, Data: body}},
+		}) {
+			s.log.Printf("exchange with %s is backed up; not sending %s", color.RedString(sess.nodeID), id)
+		}
+	}
+}
+
+// receiveBlock hands a wanted document to the fetches waiting for it and
+// cancels the want on every stream. Documents that aren't wanted are dropped.
+// It is called while receiving so cancels aren't sent on streams that are
+// backed up; those peers may still send the document, which is dropped.
+func (s *Server) receiveBlock(sess *exchangeSession, block *serverpb.ExchangeBlock) {
+	s.mu.Lock()
+	w, ok := s.mu.wants[block.Id]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := verifyID(block.Id, block.Data); err != nil {
+		s.log.Printf("peer %s sent invalid document: %+v", color.RedString(sess.nodeID), err)
+		return
+	}
+
+	s.mu.Lock()
+	if s.mu.wants[block.Id] != w {
+		// Another peer sent it first.
+		s.mu.Unlock()
+		return
+	}
+	delete(s.mu.wants, block.Id)
+	w.body = block.Data
+	close(w.received)
+	var sessions []*exchangeSession
+	for asked := range w.asked {
+		sessions = append(sessions, asked)
+	}
+	s.mu.Unlock()
+
+	for _, asked := range sessions {
+		asked.trySend(&serverpb.ExchangeMessage{Cancel: []string{block.Id}})
+	}
+}
+
+// exchangeSessions returns a session with every connected peer, opening the
+// missing ones.
+func (s *Server) exchangeSessions() []*exchangeSession {
+	s.mu.Lock()
+	var sessions []*exchangeSession
+	missing := map[string]serverpb.NodeClient{}
+	for nodeID, client := range s.mu.peers {
+		if sess, ok := s.mu.exchangePeers[nodeID]; ok {
+			sessions = append(sessions, sess)
+		} else {
+			missing[nodeID] = client
+		}
+	}
+	s.mu.Unlock()
+
+	for nodeID, client := range missing {
+		sess, err := s.openExchange(nodeID, client)
+		if err != nil {
+			s.log.Printf("failed to open exchange with %s: %+v", color.RedString(nodeID), err)
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// openExchange opens an Exchange stream to a peer. The stream is closed when
+// the server is.
+func (s *Server) openExchange(nodeID string, client serverpb.NodeClient) (*exchangeSession, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Exchange(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if existing, ok := s.mu.exchangePeers[nodeID]; ok {
+		// Another fetch opened one first.
+		s.mu.Unlock()
+		cancel()
+		return existing, nil
+	}
+	sess := newExchangeSession(nodeID)
+	s.mu.exchangePeers[nodeID] = sess
+	s.mu.Unlock()
+
+	go func() {
+		select {
+		case <-s.stopper:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	go func() {
+		defer cancel()
+		if err := s.runExchange(sess, stream); err != io.EOF && !s.stopped() {
+			s.log.Printf("exchange with %s closed: %+v", color.RedString(nodeID), err)
+		}
+	}()
+	return sess, nil
+}
+
+// fetchBlocks fetches the documents that aren't stored locally from every
+// connected peer at once. Documents no peer sends within wantTimeout are left
+// for routed lookups to find.
+func (s *Server) fetchBlocks(ctx context.Context, ids []string) error {
+	var missing []string
+	for _, id := range ids {
+		if _, err := s.localDocument(id); err == badger.ErrKeyNotFound {
+			missing = append(missing, id)
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	_, err := s.wantBlocks(ctx, s.exchangeSessions(), missing)
+	return err
+}
+
+// wantBlocks asks the sessions for the documents and stores the ones received
+// within wantTimeout. It returns the received documents keyed by ID.
+func (s *Server) wantBlocks(ctx context.Context, sessions []*exchangeSession, ids []string) (map[string][]byte, error) {
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	wants := map[string]*want{}
+	var wanted []string
+	for _, id := range ids {
+		if _, ok := wants[id]; ok {
+			continue
+		}
+		w, ok := s.mu.wants[id]
+		if !ok {
+			w = &want{
+				received: make(chan struct{}),
+				missing:  make(chan struct{}),
+				asked:    map[*exchangeSession]bool{},
+			}
+			for _, sess := range sessions {
+				w.asked[sess] = true
+			}
+			s.mu.wants[id] = w
+			wanted = append(wanted, id)
+		}
+		w.refs++
+		wants[id] = w
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.sendBatches(wanted, func(ids []string) *serverpb.ExchangeMessage {
+			return &serverpb.ExchangeMessage{Want: ids}
+		})
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, wantTimeout)
+	defer cancel()
+	bodies := map[string][]byte{}
+	var err error
+	for id, w := range wants {
+		select {
+		case <-w.received:
+		case <-w.missing:
+		case <-waitCtx.Done():
+		}
+		select {
+		case <-w.received:
+			bodies[id] = w.body
+			if err == nil {
+				err = s.putFetched(id, w.body)
+			}
+		default:
+		}
+	}
+
+	s.mu.Lock()
+	var cancelled []string
+	for id, w := range wants {
+		w.refs--
+		if w.refs == 0 && s.mu.wants[id] == w {
+			delete(s.mu.wants, id)
+			cancelled = append(cancelled, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.sendBatches(cancelled, func(ids []string) *serverpb.ExchangeMessage {
+			return &serverpb.ExchangeMessage{Cancel: ids}
+		})
+	}
+	return bodies, err
+}
+
+// Exchange serves a block exchange stream opened by a peer.
+func (s *Server) Exchange(stream serverpb.Node_ExchangeServer) error {
+	if err := s.runExchange(newExchangeSession(""), stream); err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// pipeStream is one end of an in-memory Exchange stream.
+type pipeStream struct {
+	ctx  context.Context
+	send chan<- *serverpb.ExchangeMessage
+	recv <-chan *serverpb.ExchangeMessage
+}
+
+func (p pipeStream) Send(msg *serverpb.ExchangeMessage) error {
+	select {
+	case p.send <- msg:
+		return nil
+	case <-p.ctx.Done():
+		return io.EOF
+	}
+}
+
+func (p pipeStream) Recv() (*serverpb.ExchangeMessage, error) {
+	select {
+	case msg := <-p.recv:
+		return msg, nil
+	case <-p.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func newPipe(ctx context.Context) (pipeStream, pipeStream) {
+	a := make(chan *serverpb.ExchangeMessage)
+	b := make(chan *serverpb.ExchangeMessage)
+	return pipeStream{ctx: ctx, send: a, recv: b}, pipeStream{ctx: ctx, send: b, recv: a}
+}
+
+func TestExchange(t *testing.T) {
+	a, stopA := newTestServer(t)
+	defer stopA()
+	b, stopB := newTestServer(t)
+	defer stopB()
+
+	var ids []string
+	for _, data := range []string{"one", "two", "three"} {
+		id, err := b.storeDocument(serverpb.Document{Data: []byte(data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	absent := a.hashDocument([]byte("absent"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	endA, endB := newPipe(ctx)
+	sess := newExchangeSession("b")
+	go a.runExchange(sess, endA)
+	go b.runExchange(newExchangeSession(""), endB)
+
+	start := time.Now()
+	bodies, err := a.wantBlocks(ctx, []*exchangeSession{sess}, append(ids, absent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != len(ids) {
+		t.Fatalf("expected %d documents; got %d", len(ids), len(bodies))
+	}
+	// The peer says it doesn't have the absent document so there's no need
+	// to wait for it.
+	if elapsed := time.Since(start); elapsed >= wantTimeout {
+		t.Fatalf("expected missing document to be reported; waited %s", elapsed)
+	}
+	for _, id := range ids {
+		if _, err := a.localDocument(id); err != nil {
+			t.Fatalf("%s wasn't fetched: %+v", id, err)
+		}
+	}
+	if _, err := a.localDocument(absent); err != badger.ErrKeyNotFound {
+		t.Fatalf("expected %s to be missing; got %+v", absent, err)
+	}
+
+	a.mu.Lock()
+	wants := len(a.mu.wants)
+	a.mu.Unlock()
+	if wants != 0 {
+		t.Fatalf("expected every want to be released; %d left", wants)
+	}
+
+	// Documents that aren't wanted are dropped.
+	body, err := b.localDocument(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwanted := a.hashDocument([]byte("unwanted"))
+	a.receiveBlock(sess, &serverpb.ExchangeBlock{Id: unwanted, Data: body})
+	if _, err := a.localDocument(unwanted); err != badger.ErrKeyNotFound {
+		t.Fatalf("expected unwanted document to be dropped; got %+v", err)
+	}
+}
+
+func TestExchangeLimits(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	// Wants of documents that aren't stored are remembered up to a limit.
+	sess := newExchangeSession("")
+	defer close(sess.done)
+	go func() {
+		for {
+			select {
+			case <-sess.out:
+			case <-sess.done:
+				return
+			}
+		}
+	}()
+	var ids []string
+	for i := 0; i < maxSessionWants+10; i++ {
+		ids = append(ids, s.hashDocument([]byte(fmt.Sprint(i))))
+	}
+	s.serveWants(sess, ids)
+	sess.mu.Lock()
+	wants := len(sess.wants)
+	sess.mu.Unlock()
+	if wants != maxSessionWants {
+		t.Fatalf("expected %d wants to be remembered; got %d", maxSessionWants, wants)
+	}
+
+	// Storing a wanted document doesn't wait for a stream that is backed up.
+	full := newExchangeSession("")
+	for i := 0; i < exchangeBuffer; i++ {
+		full.out <- &serverpb.ExchangeMessage{}
+	}
+	wanted := serverpb.Document{Data: []byte("wanted")}
+	body, err := wanted.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full.wants[s.hashDocument(body)] = true
+	s.mu.Lock()
+	s.mu.exchanges[full] = struct{}{}
+	s.mu.Unlock()
+
+	stored := make(chan error, 1)
+	go func() {
+		_, err := s.storeDocument(wanted)
+		stored <- err
+	}()
+	select {
+	case err := <-stored:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("storing a wanted document blocked on a full stream")
+	}
+}
+
+func TestExchangeBackedUp(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	id, err := s.storeDocument(serverpb.Document{Data: []byte("wanted")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer never reads what is sent to it, so every queue fills up.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recv := make(chan *serverpb.ExchangeMessage)
+	stream := pipeStream{ctx: ctx, send: make(chan *serverpb.ExchangeMessage), recv: recv}
+	go s.runExchange(newExchangeSession(""), stream)
+
+	// Receiving keeps going so the peer's own sends don't block.
+	for i := 0; i < 4*exchangeBuffer; i++ {
+		select {
+		case recv <- &serverpb.ExchangeMessage{Want: []string{id}}:
+		case <-time.After(time.Second):
+			t.Fatalf("receiving blocked after %d wants", i)
+		}
+	}
+}
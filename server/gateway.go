@@ -0,0 +1,168 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+)
+
+const (
+	ipfsPrefix = "/ipfs/"
+	ipnsPrefix = "/ipns/"
+
+	// ipnsMaxAge is how long, in seconds, clients may cache documents served
+	// through a reference, which can be updated at any time.
+	ipnsMaxAge = 60
+)
+
+var directoryTemplate = template.Must(template.New("directory").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<ul>
+{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type directoryEntry struct {
+	Name string
+	Href string
+}
+
+// gatewayHandler returns the handler for the HTTP gateway.
+func (s *Server) gatewayHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ipfsPrefix, s.serveIPFS)
+	mux.HandleFunc(ipnsPrefix, s.serveIPNS)
+	return mux
+}
+
+// serveIPFS serves GET /ipfs/<id>[/path]. Since documents are addressed by
+// their hash they never change and can be cached forever.
+func (s *Server) serveIPFS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, ipfsPrefix)
+	s.servePath(w, r, p, "public, max-age=31536000, immutable")
+}
+
+// serveIPNS serves GET /ipns/<reference-id>[/path] by resolving the reference
+// to a document. References can change so responses are only cached briefly.
+func (s *Server) serveIPNS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, ipnsPrefix), "/", 2)
+	root, err := s.resolveReference(r.Context(), parts[0])
+	if err != nil {
+		s.gatewayError(w, r, err)
+		return
+	}
+	p := root
+	if len(parts) == 2 {
+		p = root + "/" + parts[1]
+	}
+	s.servePath(w, r, p, "public, max-age="+strconv.Itoa(ipnsMaxAge))
+}
+
+// servePath resolves a document path and serves the document it refers to
+// with the specified Cache-Control header, unless it is encrypted.
+func (s *Server) servePath(w http.ResponseWriter, r *http.Request, p, cacheControl string) {
+	id, doc, key, err := s.resolvePath(r.Context(), p)
+	if err != nil {
+		s.gatewayError(w, r, err)
+		return
+	}
+
+	if key != nil {
+		// Keep the decrypted data out of shared caches, and the key out of
+		// the ETag.
+		cacheControl = "private, no-store"
+		id, _, _ = parseCapability(id)
+	}
+	etag := strconv.Quote(id)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.serveDocument(w, r, doc, key)
+}
+
+// gatewayError responds with 404 Not Found if a document, reference or path
+// doesn't exist and 500 Internal Server Error for any other error.
+func (s *Server) gatewayError(w http.ResponseWriter, r *http.Request, err error) {
+	switch errors.Cause(err) {
+	case ErrDocumentNotFound, ErrReferenceNotFound, ErrPathNotFound, badger.ErrKeyNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		s.log.Printf("gateway: error serving %s: %+v", r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveDocument writes the data of a document, or a listing of its children
+// if it is a directory.
+func (s *Server) serveDocument(w http.ResponseWriter, r *http.Request, doc serverpb.Document, key []byte) {
+	if doc.ContentType == "directory" {
+		s.serveDirectory(w, r, doc)
+		return
+	}
+
+	contentType := doc.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	// ServeContent handles Range requests, seeking so only the blocks
+	// containing the requested bytes are fetched.
+	http.ServeContent(w, r, "", time.Time{}, s.newDAGReader(r.Context(), doc, key))
+}
+
+func (s *Server) serveDirectory(w http.ResponseWriter, r *http.Request, doc serverpb.Document) {
+	var names []string
+	for name := range doc.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := struct {
+		Path    string
+		Entries []directoryEntry
+	}{
+		Path: r.URL.Path,
+	}
+	base := strings.TrimSuffix(r.URL.EscapedPath(), "/")
+	for _, name := range names {
+		data.Entries = append(data.Entries, directoryEntry{
+			Name: name,
+			Href: base + "/" + url.PathEscape(name),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := directoryTemplate.Execute(w, data); err != nil {
+		s.log.Printf("gateway: error serving %s: %+v", r.URL.Path, err)
+	}
+}
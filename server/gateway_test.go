@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+	"testing"
+)
+
+func TestGateway(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("hello world\n"), blockSize/4)
+	file, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: data, ContentType: "text/plain"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			ContentType: "directory",
+			Children: map[string]string{
+				"hello.txt":   file.DocumentId,
+				"what?#%.txt": file.DocumentId,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.gatewayHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ipfs/" + dir.DocumentId + "/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("unexpected response %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain" {
+		t.Fatalf("unexpected content type %q", got)
+	}
+	etag := resp.Header.Get("ETag")
+	if !strings.Contains(etag, file.DocumentId) || !strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+		t.Fatalf("unexpected caching headers %+v", resp.Header)
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/ipfs/"+file.DocumentId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", blockSize-6, blockSize+5))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[blockSize-6:blockSize+6]) {
+		t.Fatalf("unexpected range response %d: %q", resp.StatusCode, body)
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(data)))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416 for a range past the end; got %d", resp.StatusCode)
+	}
+
+	req.Header.Del("Range")
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304; got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.URL + "/ipfs/" + dir.DocumentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `href="/ipfs/`+dir.DocumentId+`/hello.txt"`) {
+		t.Fatalf("expected directory listing; got %s", body)
+	}
+	if !strings.Contains(string(body), `href="/ipfs/`+dir.DocumentId+`/what%3F%23%25.txt"`) {
+		t.Fatalf("expected escaped link; got %s", body)
+	}
+
+	resp, err = http.Get(ts.URL + "/ipfs/" + dir.DocumentId + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404; got %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayEncrypted(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	file, err := s.Add(context.Background(), &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: []byte("secret"), ContentType: "text/plain"},
+		Encrypt:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.gatewayHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ipfs/" + file.Capability)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "secret" {
+		t.Fatalf("unexpected response %d: %q", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("ETag"); got != `"`+file.DocumentId+`"` {
+		t.Fatalf("expected the document ID as ETag; got %s", got)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "private, no-store" {
+		t.Fatalf("expected encrypted documents not to be cached; got %q", got)
+	}
+
+	// Errors don't echo the key.
+	invalid := file.Capability + "x"
+	resp, err = http.Get(ts.URL + "/ipfs/" + invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("expected an error for invalid capability")
+	}
+	if key := invalid[len(file.DocumentId)+1:]; strings.Contains(string(body), key) {
+		t.Fatalf("error leaks the key: %s", body)
+	}
+}
+
+func TestGatewayReference(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	file, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: []byte("v1"), ContentType: "text/plain"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			ContentType: "directory",
+			Children:    map[string]string{"index.txt": file.DocumentId},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addReference := func(record string) string {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := s.AddReference(ctx, &serverpb.AddReferenceRequest{
+			PrivKey: pem.EncodeToMemory(pemBlockForKey(key)),
+			Record:  record,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.ReferenceId
+	}
+	ref := addReference("document:" + dir.DocumentId)
+	indirect := addReference("reference:" + ref)
+
+	ts := httptest.NewServer(s.gatewayHandler())
+	defer ts.Close()
+
+	for _, id := range []string{ref, indirect} {
+		resp, err := http.Get(ts.URL + "/ipns/" + id + "/index.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != "v1" {
+			t.Fatalf("unexpected response %d: %q", resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Cache-Control"); strings.Contains(got, "immutable") {
+			t.Fatalf("expected short cache TTL; got %q", got)
+		}
+	}
+
+	for id, status := range map[string]int{
+		"missing":               http.StatusNotFound,
+		addReference("invalid"): http.StatusInternalServerError,
+	} {
+		resp, err := http.Get(ts.URL + "/ipns/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("%s: expected %d; got %d", id, status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// markPinned returns the IDs of every locally stored document that is
+// reachable from a pin or stored by an add in progress. Recursive pins are
+// followed through Children and Blocks; links to documents that aren't stored
+// locally are skipped.
+func (s *Server) markPinned() (map[string]bool, error) {
+	pins, err := s.pins()
+	if err != nil {
+		return nil, err
+	}
+
+	marked := map[string]bool{}
+	var stack []string
+	for _, pin := range pins {
+		if pin.Recursive {
+			stack = append(stack, pin.DocumentId)
+		} else {
+			marked[pin.DocumentId] = true
+		}
+	}
+	recursed := map[string]bool{}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if recursed[id] {
+			continue
+		}
+		recursed[id] = true
+		marked[id] = true
+
+		body, err := s.localDocument(id)
+		if err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var doc serverpb.Document
+		if err := doc.Unmarshal(body); err != nil {
+			return nil, err
+		}
+		stack = append(stack, documentLinks(doc)...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.mu.adding {
+		marked[id] = true
+	}
+	return marked, nil
+}
+
+// localDocumentIDs returns the IDs of every locally stored document.
+func (s *Server) localDocumentIDs() ([]string, error) {
+	var ids []string
+	prefix := documentKey("")
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			ids = append(ids, strings.TrimPrefix(string(it.Item().Key()), string(prefix)))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// garbageCollect deletes every local document that isn't reachable from a pin
+// and returns the number of documents removed.
+func (s *Server) garbageCollect() (int64, error) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+
+	marked, err := s.markPinned()
+	if err != nil {
+		return 0, err
+	}
+	ids, err := s.localDocumentIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	for _, id := range ids {
+		if marked[id] {
+			continue
+		}
+		if err := s.deleteDocument(id); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (s *Server) GarbageCollect(ctx context.Context, in *serverpb.GarbageCollectRequest) (*serverpb.GarbageCollectResponse, error) {
+	removed, err := s.garbageCollect()
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.GarbageCollectResponse{
+		Removed: removed,
+	}, nil
+}
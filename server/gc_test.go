@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"io"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	// Added documents are pinned recursively, including their blocks.
+	file, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: make([]byte, 2*blockSize)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Directly pinned directories don't keep their children.
+	child, err := s.storeDocument(serverpb.Document{Data: []byte("child")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := s.storeDocument(serverpb.Document{
+		ContentType: "directory",
+		Children:    map[string]string{"child": child},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Pin(ctx, &serverpb.PinRequest{DocumentId: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	unpinned, err := s.storeDocument(serverpb.Document{Data: []byte("unpinned")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.GarbageCollect(ctx, &serverpb.GarbageCollectRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Removed != 2 {
+		t.Fatalf("expected 2 documents removed; got %d", resp.Removed)
+	}
+	for _, id := range []string{child, unpinned} {
+		if _, err := s.localDocument(id); err != badger.ErrKeyNotFound {
+			t.Fatalf("expected %s to be removed; got %v", id, err)
+		}
+	}
+	if _, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: file.DocumentId}); err != nil {
+		t.Fatal(err)
+	}
+
+	pins, err := s.ListPins(ctx, &serverpb.ListPinsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins.Pins) != 2 {
+		t.Fatalf("expected 2 pins; got %+v", pins.Pins)
+	}
+
+	if _, err := s.Unpin(ctx, &serverpb.UnpinRequest{DocumentId: file.DocumentId}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Unpin(ctx, &serverpb.UnpinRequest{DocumentId: file.DocumentId}); err == nil {
+		t.Fatal("expected error unpinning a document that isn't pinned")
+	}
+	resp, err = s.GarbageCollect(ctx, &serverpb.GarbageCollectRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Removed != 2 {
+		t.Fatalf("expected root and block to be removed; got %d", resp.Removed)
+	}
+}
+
+// gcReader returns size bytes and garbage collects after the first block has
+// been read.
+type gcReader struct {
+	t       *testing.T
+	s       *Server
+	size    int
+	read    int
+	removed int64
+}
+
+func (r *gcReader) Read(p []byte) (int, error) {
+	if r.read >= r.size {
+		return 0, io.EOF
+	}
+	if r.read >= 2*blockSize {
+		removed, err := r.s.garbageCollect()
+		if err != nil {
+			r.t.Fatal(err)
+		}
+		r.removed += removed
+	}
+	if len(p) > r.size-r.read {
+		p = p[:r.size-r.read]
+	}
+	for i := range p {
+		p[i] = byte((r.read + i) / blockSize)
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestGarbageCollectDuringAdd(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	r := &gcReader{t: t, s: s, size: 4 * blockSize}
+	id, release, err := s.addFile(serverpb.Document{}, r, serverpb.FIXED, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.removed != 0 {
+		t.Fatalf("expected no documents removed during the add; got %d", r.removed)
+	}
+	if _, err := s.openDocument(context.Background(), id, nil); err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	removed, err := s.garbageCollect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 5 {
+		t.Fatalf("expected 5 documents removed once released; got %d", removed)
+	}
+}
+
+func TestPinMissing(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	missing := s.hashDocument([]byte("missing"))
+	for _, recursive := range []bool{true, false} {
+		if _, err := s.Pin(ctx, &serverpb.PinRequest{DocumentId: missing, Recursive: recursive}); err == nil {
+			t.Fatal("expected error pinning a missing document")
+		}
+	}
+	pins, err := s.ListPins(ctx, &serverpb.ListPinsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins.Pins) != 0 {
+		t.Fatalf("expected failed pins to be removed; got %+v", pins.Pins)
+	}
+}
+
+func TestGarbageCollectUnpinnedAdd(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	// Documents added without a pin are kept until a pinned directory links
+	// to them.
+	ctx := context.Background()
+	child, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: []byte("child")},
+		NoPin:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := s.garbageCollect(); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Fatalf("expected unpinned add to be kept; got %d removed", removed)
+	}
+	dir, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{
+			ContentType: "directory",
+			Children:    map[string]string{"child": child.DocumentId},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pins, err := s.ListPins(ctx, &serverpb.ListPinsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins.Pins) != 1 || pins.Pins[0].DocumentId != dir.DocumentId {
+		t.Fatalf("expected only the directory to be pinned; got %+v", pins.Pins)
+	}
+}
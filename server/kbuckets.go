@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"math/bits"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// kademliaK is the maximum number of nodes in a k-bucket and the number
+	// of nodes closest to a key that records are stored on.
+	kademliaK = 20
+
+	// kademliaAlpha is the number of nodes queried concurrently during a
+	// lookup.
+	kademliaAlpha = 3
+
+	keyBits = sha1.Size * 8
+)
+
+// kademliaKey is a position in the 160 bit Kademlia key space.
+type kademliaKey [sha1.Size]byte
+
+// nodeKey returns the key of a node, which is its decoded node ID.
+func nodeKey(nodeID string) (kademliaKey, error) {
+	var key kademliaKey
+	raw, err := base64.StdEncoding.DecodeString(nodeID)
+	if err != nil {
+		return key, errors.Wrapf(err, "node ID %q", nodeID)
+	}
+	if len(raw) != len(key) {
+		return key, errors.Errorf("node ID %q: expected %d bytes; got %d", nodeID, len(key), len(raw))
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// valueKey returns the key records about a document or reference are stored
+// under.
+func valueKey(id string) kademliaKey {
+	return sha1.Sum([]byte(id))
+}
+
+func (k kademliaKey) distance(other kademliaKey) kademliaKey {
+	var d kademliaKey
+	for i := range k {
+		d[i] = k[i] ^ other[i]
+	}
+	return d
+}
+
+// commonPrefixLen returns the number of leading bits shared by two keys.
+func commonPrefixLen(a, b kademliaKey) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return keyBits
+}
+
+// sortByDistance sorts nodes by their distance to key, closest first.
+func sortByDistance(nodes []serverpb.NodeMeta, key kademliaKey) {
+	distances := map[string]kademliaKey{}
+	for _, meta := range nodes {
+		// IDs are validated before nodes are added so this can't fail.
+		k, _ := nodeKey(meta.Id)
+		distances[meta.Id] = k.distance(key)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := distances[nodes[i].Id], distances[nodes[j].Id]
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+}
+
+// KBuckets is a Kademlia routing table. Bucket i holds nodes whose keys share
+// exactly i leading bits with the local key, least recently seen first.
+type KBuckets struct {
+	mu sync.Mutex
+
+	self    kademliaKey
+	buckets [keyBits][]serverpb.NodeMeta
+	// pinging is set for the full buckets whose least recently seen node is
+	// being checked.
+	pinging [keyBits]bool
+}
+
+func NewKBuckets(self kademliaKey) *KBuckets {
+	return &KBuckets{
+		self: self,
+	}
+}
+
+// Update records that a node was seen. Nodes already in their bucket are moved
+// to the end. If the bucket of a new node is full the node is dropped and the
+// least recently seen node of the bucket is returned, unless one is already
+// being checked; the caller pings it and calls Evict if it doesn't respond.
+func (kb *KBuckets) Update(meta serverpb.NodeMeta) (*serverpb.NodeMeta, error) {
+	key, err := nodeKey(meta.Id)
+	if err != nil {
+		return nil, err
+	}
+	i := commonPrefixLen(kb.self, key)
+	if i == keyBits {
+		return nil, nil
+	}
+
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	bucket := kb.buckets[i]
+	for j, existing := range bucket {
+		if existing.Id == meta.Id {
+			if meta.Updated < existing.Updated {
+				meta = existing
+			}
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			kb.buckets[i] = append(bucket, meta)
+			if j == 0 {
+				kb.pinging[i] = false
+			}
+			return nil, nil
+		}
+	}
+	if len(bucket) < kademliaK {
+		kb.buckets[i] = append(bucket, meta)
+		return nil, nil
+	}
+	if kb.pinging[i] {
+		return nil, nil
+	}
+	kb.pinging[i] = true
+	oldest := bucket[0]
+	return &oldest, nil
+}
+
+// Evict replaces a node returned by Update that didn't respond with the node
+// that was dropped in its place.
+func (kb *KBuckets) Evict(nodeID string, meta serverpb.NodeMeta) error {
+	kb.Remove(nodeID)
+	key, err := nodeKey(meta.Id)
+	if err != nil {
+		return err
+	}
+	kb.mu.Lock()
+	kb.pinging[commonPrefixLen(kb.self, key)] = false
+	kb.mu.Unlock()
+	_, err = kb.Update(meta)
+	return err
+}
+
+// Remove removes a node from the routing table.
+func (kb *KBuckets) Remove(nodeID string) {
+	key, err := nodeKey(nodeID)
+	if err != nil {
+		return
+	}
+	i := commonPrefixLen(kb.self, key)
+	if i == keyBits {
+		return
+	}
+
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	bucket := kb.buckets[i]
+	for j, existing := range bucket {
+		if existing.Id == nodeID {
+			kb.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to n known nodes closest to key.
+func (kb *KBuckets) Closest(key kademliaKey, n int) []serverpb.NodeMeta {
+	kb.mu.Lock()
+	var nodes []serverpb.NodeMeta
+	for _, bucket := range kb.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	kb.mu.Unlock()
+
+	sortByDistance(nodes, key)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// Len returns the number of nodes in the routing table.
+func (kb *KBuckets) Len() int {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	n := 0
+	for _, bucket := range kb.buckets {
+		n += len(bucket)
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/base64"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+)
+
+func testNodeMeta(key kademliaKey) serverpb.NodeMeta {
+	return serverpb.NodeMeta{Id: base64.StdEncoding.EncodeToString(key[:])}
+}
+
+func TestKBucketsClosest(t *testing.T) {
+	var self kademliaKey
+	kb := NewKBuckets(self)
+
+	var keys []kademliaKey
+	for i := 0; i < 8; i++ {
+		var key kademliaKey
+		key[len(key)-1] = byte(1 << uint(i))
+		keys = append(keys, key)
+		if _, err := kb.Update(testNodeMeta(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The local node is never added.
+	if _, err := kb.Update(testNodeMeta(self)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kb.Update(serverpb.NodeMeta{Id: "invalid"}); err == nil {
+		t.Fatal("expected error for invalid node ID")
+	}
+	if n := kb.Len(); n != len(keys) {
+		t.Fatalf("expected %d nodes; got %d", len(keys), n)
+	}
+
+	var target kademliaKey
+	target[len(target)-1] = 0x05
+	got := kb.Closest(target, 3)
+	want := []kademliaKey{keys[2], keys[0], keys[1]}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d nodes; got %d", len(want), len(got))
+	}
+	for i, key := range want {
+		if got[i].Id != testNodeMeta(key).Id {
+			t.Errorf("%d. expected %s; got %s", i, testNodeMeta(key).Id, got[i].Id)
+		}
+	}
+
+	kb.Remove(testNodeMeta(keys[2]).Id)
+	if got := kb.Closest(target, 1); len(got) != 1 || got[0].Id != testNodeMeta(keys[0]).Id {
+		t.Fatalf("expected %s after removal; got %+v", testNodeMeta(keys[0]).Id, got)
+	}
+}
+
+func TestKBucketsFull(t *testing.T) {
+	var self kademliaKey
+	kb := NewKBuckets(self)
+
+	// Every key with the first bit set falls in bucket 0.
+	for i := 0; i < kademliaK+5; i++ {
+		var key kademliaKey
+		key[0] = 0x80
+		key[len(key)-1] = byte(i)
+		if _, err := kb.Update(testNodeMeta(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := kb.Len(); n != kademliaK {
+		t.Fatalf("expected a full bucket of %d nodes; got %d", kademliaK, n)
+	}
+
+	// Seeing a node again moves it to the end of its bucket.
+	var first kademliaKey
+	first[0] = 0x80
+	if _, err := kb.Update(testNodeMeta(first)); err != nil {
+		t.Fatal(err)
+	}
+	bucket := kb.buckets[0]
+	if last := bucket[len(bucket)-1]; last.Id != testNodeMeta(first).Id {
+		t.Fatalf("expected %s to be most recently seen; got %s", testNodeMeta(first).Id, last.Id)
+	}
+
+	// New nodes of a full bucket return the least recently seen node to
+	// check, one at a time.
+	var extra, another kademliaKey
+	extra[0], extra[1] = 0x80, 0x01
+	another[0], another[1] = 0x80, 0x02
+	oldest, err := kb.Update(testNodeMeta(extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldest == nil || oldest.Id != bucket[0].Id {
+		t.Fatalf("expected %s to be checked; got %+v", bucket[0].Id, oldest)
+	}
+	if pending, err := kb.Update(testNodeMeta(another)); err != nil || pending != nil {
+		t.Fatalf("expected no node to check while one is pending; got %+v, %v", pending, err)
+	}
+	if err := kb.Evict(oldest.Id, testNodeMeta(extra)); err != nil {
+		t.Fatal(err)
+	}
+	bucket = kb.buckets[0]
+	if len(bucket) != kademliaK || bucket[0].Id == oldest.Id || bucket[len(bucket)-1].Id != testNodeMeta(extra).Id {
+		t.Fatalf("expected %s to replace %s", testNodeMeta(extra).Id, oldest.Id)
+	}
+}
@@ -96,7 +96,12 @@ func nodeMetaSign(meta serverpb.NodeMeta, key *ecdsa.PrivateKey) (string, error)
 	if err != nil {
 		return "", err
 	}
-	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	return signHash(hash, key)
+}
+
+// signHash signs a hash with a node's private key.
+func signHash(hash []byte, key *ecdsa.PrivateKey) (string, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
 	if err != nil {
 		return "", err
 	}
@@ -107,6 +112,27 @@ func nodeMetaSign(meta serverpb.NodeMeta, key *ecdsa.PrivateKey) (string, error)
 	return base64.StdEncoding.EncodeToString(sig), nil
 }
 
+// verifyHash checks that a hash was signed with the private key of the node
+// described by meta, which must be valid.
+func verifyHash(meta serverpb.NodeMeta, hash []byte, signature string) error {
+	publicKey, err := nodeMetaPublicKey(meta)
+	if err != nil {
+		return err
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	var sig EcdsaSignature
+	if _, err := asn1.Unmarshal(rawSig, &sig); err != nil {
+		return err
+	}
+	if !ecdsa.Verify(publicKey, hash, sig.R, sig.S) {
+		return errors.Errorf("invalid signature by %s", meta.Id)
+	}
+	return nil
+}
+
 func nodeMetaId(meta serverpb.NodeMeta) string {
 	id := sha1.Sum([]byte(meta.PublicKey))
 	return base64.StdEncoding.EncodeToString(id[:])
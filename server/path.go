@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPathNotFound is returned when a path names a child a directory doesn't
+// have.
+var ErrPathNotFound = errors.New("no such file or directory")
+
+// legacyIDLength is the length of the base64 encoded SHA-1 IDs, which may
+// contain '/'.
+const legacyIDLength = 28
+
+// splitPath splits a path of the form <root-id>/sub/dir/file.txt into the root
+// document ID and the names to follow from it.
+func splitPath(path string) (string, []string) {
+	var root string
+	if len(path) >= legacyIDLength && (len(path) == legacyIDLength || path[legacyIDLength] == '/') {
+		if raw, err := base64.StdEncoding.DecodeString(path[:legacyIDLength]); err == nil && len(raw) == legacyDigestSize {
+			root = path[:legacyIDLength]
+			path = path[legacyIDLength:]
+		}
+	}
+	if root == "" {
+		parts := strings.SplitN(path, "/", 2)
+		root = parts[0]
+		path = ""
+		if len(parts) == 2 {
+			path = parts[1]
+		}
+	}
+
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return root, names
+}
+
+// resolvePath walks the children of directory documents from the root of a
+// path, fetching documents from the network as needed. The root and children
+// may be capabilities of encrypted documents. It returns the ID, or the
+// capability, and document the path refers to, along with the key needed to
+// read the blocks of an encrypted file. The lengths of the blocks of a chunked
+// file are checked.
+func (s *Server) resolvePath(ctx context.Context, path string) (string, serverpb.Document, []byte, error) {
+	root, names := splitPath(path)
+	id, key, err := parseCapability(root)
+	if err != nil {
+		return "", serverpb.Document{}, nil, err
+	}
+	doc, err := s.openDocument(ctx, id, key)
+	if err != nil {
+		return "", serverpb.Document{}, nil, err
+	}
+	rootID := id
+	for i, name := range names {
+		child, ok := doc.Children[name]
+		if !ok {
+			return "", serverpb.Document{}, nil, errors.Wrapf(ErrPathNotFound, "%s", strings.Join(append([]string{rootID}, names[:i+1]...), "/"))
+		}
+		id, key, err = parseCapability(child)
+		if err != nil {
+			return "", serverpb.Document{}, nil, err
+		}
+		doc, err = s.openDocument(ctx, id, key)
+		if err != nil {
+			return "", serverpb.Document{}, nil, err
+		}
+	}
+	if err := validateFile(doc); err != nil {
+		return "", serverpb.Document{}, nil, errors.Wrapf(err, "%s", id)
+	}
+	if key != nil {
+		return formatCapability(id, key), doc, key, nil
+	}
+	return id, doc, nil, nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"reflect"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	const legacy = "gCCkLLXayBw/JtyVbAPNMq7zK8o="
+	testCases := []struct {
+		path  string
+		root  string
+		names []string
+	}{
+		{"bafy", "bafy", nil},
+		{"bafy/", "bafy", nil},
+		{"bafy/a/b.txt", "bafy", []string{"a", "b.txt"}},
+		{"bafy//a/", "bafy", []string{"a"}},
+		{legacy, legacy, nil},
+		{legacy + "/a", legacy, []string{"a"}},
+	}
+	for i, tc := range testCases {
+		root, names := splitPath(tc.path)
+		if root != tc.root || !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("%d. splitPath(%q) = %q, %q; want %q, %q", i, tc.path, root, names, tc.root, tc.names)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	file, err := s.storeDocument(serverpb.Document{Data: []byte("hello"), ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := s.storeDocument(serverpb.Document{
+		ContentType: "directory",
+		Children:    map[string]string{"file.txt": file},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := s.storeDocument(serverpb.Document{
+		ContentType: "directory",
+		Children:    map[string]string{"sub": sub},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: root + "/sub/file.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DocumentId != file || string(resp.Document.Data) != "hello" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	resp, err = s.Get(ctx, &serverpb.GetRequest{DocumentId: root + "/sub/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DocumentId != sub {
+		t.Fatalf("expected %s; got %s", sub, resp.DocumentId)
+	}
+
+	if _, err := s.Get(ctx, &serverpb.GetRequest{DocumentId: root + "/missing"}); err == nil {
+		t.Fatal("expected error for missing path")
+	}
+}
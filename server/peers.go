@@ -112,6 +112,10 @@ func (s *Server) AddNode(meta serverpb.NodeMeta) error {
 
 	s.log.Printf("AddNode %s", color.RedString(meta.Id))
 
+	if err := s.dhtUpdate(meta); err != nil {
+		return err
+	}
+
 	new := s.addNodeMeta(meta)
 	if err := s.persistNodeMeta(meta); err != nil {
 		return err
@@ -157,6 +161,15 @@ func (s *Server) AddNode(meta serverpb.NodeMeta) error {
 			return err
 		}
 	}
+	// Documents that need more replicas may be replicated to the new peer.
+	s.scheduleReplication()
+	if s.dhtMode() {
+		// Provider records are stored on the closest nodes, which are
+		// reannounced to periodically.
+		go s.dhtBootstrap()
+	} else {
+		s.scheduleAnnounceTo(meta.Id)
+	}
 
 	go func() {
 		for {
@@ -167,11 +180,21 @@ func (s *Server) AddNode(meta serverpb.NodeMeta) error {
 				delete(s.mu.peers, meta.Id)
 				delete(s.mu.peerConns, meta.Id)
 				s.mu.Unlock()
+				s.rt.RemoveEntry(meta.Id)
+				s.kb.Remove(meta.Id)
+				if err := s.removeReplicaHolder(meta.Id); err != nil {
+					s.log.Printf("failed to update replicas: %s: %+v", color.RedString(meta.Id), err)
+				}
 				if err := conn.Close(); err != nil {
 					s.log.Printf("failed to close connection: %s: %+v", color.RedString(meta.Id), err)
 				}
 				return
 			}
+			if !s.dhtMode() {
+				if err := s.updateRoutes(ctx, meta.Id, client); err != nil {
+					s.log.Printf("routing table update error: %s: %+v", color.RedString(meta.Id), err)
+				}
+			}
 			time.Sleep(heartBeatInterval)
 		}
 	}()
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+)
+
+const (
+	recursivePinPrefix = "/pin/recursive/"
+	directPinPrefix    = "/pin/direct/"
+	replicaPinPrefix   = "/pin/replica/"
+
+	// addLease is how long garbage collection and eviction keep the documents
+	// stored by an add that doesn't pin them.
+	addLease = time.Hour
+)
+
+func pinKey(id string, recursive bool) []byte {
+	if recursive {
+		return []byte(recursivePinPrefix + id)
+	}
+	return []byte(directPinPrefix + id)
+}
+
+// replicaPinKey returns the key of the recursive pin held on a document on
+// behalf of the node origin, which replicates it to this node. The pin is
+// stored apart from the node's own pins so origin can release it.
+func replicaPinKey(id, origin string) []byte {
+	return []byte(replicaPinPrefix + origin + "/" + id)
+}
+
+// pin marks a document as pinned so it isn't garbage collected.
+func (s *Server) pin(id string, recursive bool) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(pinKey(id, recursive), nil)
+	})
+}
+
+// pinAdded pins the root of an added document recursively and sets its
+// replication factor.
+func (s *Server) pinAdded(id string, replicationFactor int32) error {
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	if s.stopped() {
+		return ErrStopped
+	}
+
+	if err := s.pin(id, true); err != nil {
+		return err
+	}
+	s.queuePinAnnounce(id)
+	return s.setReplicationFactor(id, s.replicationFactor(replicationFactor))
+}
+
+// leaseAdded keeps the documents stored by an unpinned add until addLease has
+// passed, then releases them.
+func (s *Server) leaseAdded(release func()) {
+	time.AfterFunc(addLease, release)
+}
+
+// queuePinAnnounce schedules a newly pinned document to be announced in DHT
+// mode, where only pinned documents are announced. It may have been stored,
+// and its announcement skipped, before it was pinned.
+func (s *Server) queuePinAnnounce(id string) {
+	if s.dhtMode() {
+		s.queueAnnounce(id)
+	}
+}
+
+// pins returns every pinned document, including replicas.
+func (s *Server) pins() ([]serverpb.Pin, error) {
+	var pins []serverpb.Pin
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for _, prefix := range []string{recursivePinPrefix, directPinPrefix} {
+			for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+				pins = append(pins, serverpb.Pin{
+					DocumentId: strings.TrimPrefix(string(it.Item().Key()), prefix),
+					Recursive:  prefix == recursivePinPrefix,
+				})
+			}
+		}
+
+		// Replica pins store the pin since the key holds two IDs.
+		prefix := []byte(replicaPinPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			body, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var pin serverpb.Pin
+			if err := pin.Unmarshal(body); err != nil {
+				return err
+			}
+			pins = append(pins, pin)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// pinnedRecursively returns whether the node itself pins a document
+// recursively.
+func (s *Server) pinnedRecursively(id string) (bool, error) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(pinKey(id, true))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Pin fetches a document, and for recursive pins everything linked from it,
+// and pins it.
+func (s *Server) Pin(ctx context.Context, in *serverpb.PinRequest) (*serverpb.PinResponse, error) {
+	if err := s.pinFetched(ctx, in.DocumentId, in.Recursive); err != nil {
+		return nil, err
+	}
+	return &serverpb.PinResponse{}, nil
+}
+
+// pinFetched pins a document and fetches it, and for recursive pins everything
+// linked from it, see fetchPinned.
+func (s *Server) pinFetched(ctx context.Context, id string, recursive bool) error {
+	return s.fetchPinned(ctx, id, recursive, pinKey(id, recursive), nil)
+}
+
+// fetchPinned stores the pin with the specified key and value and then fetches
+// the pinned document, and for recursive pins everything linked from it.
+// Adding the pin first lets garbage collection keep the documents as they
+// arrive without gcMu being held across network requests: fetched documents
+// are stored under gcMu after the documents linking to them, see putFetched.
+// The pin is removed again if the fetch fails, unless it existed before.
+func (s *Server) fetchPinned(ctx context.Context, id string, recursive bool, key, value []byte) error {
+	existed, err := s.addPin(key, value)
+	if err != nil {
+		return err
+	}
+	if recursive {
+		err = s.fetchDAG(ctx, id)
+	} else {
+		_, err = s.getDocument(ctx, id)
+	}
+	if err == nil && !existed {
+		s.queuePinAnnounce(id)
+	}
+	if err == nil || existed {
+		return err
+	}
+	if _, err := s.removePin(key); err != nil && err != ErrStopped {
+		s.log.Printf("failed to remove pin of %s: %+v", id, err)
+	}
+	return err
+}
+
+// addPin stores a pin and returns whether it existed already.
+func (s *Server) addPin(key, value []byte) (bool, error) {
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	if s.stopped() {
+		return false, ErrStopped
+	}
+
+	var existed bool
+	err := s.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err == nil {
+			existed = true
+			return nil
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(key, value)
+	})
+	return existed, err
+}
+
+// removePin deletes the pins with the specified keys and returns whether any
+// of them existed.
+func (s *Server) removePin(keys ...[]byte) (bool, error) {
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	if s.stopped() {
+		return false, ErrStopped
+	}
+
+	var found bool
+	err := s.db.Update(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			found = true
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Unpin removes both recursive and direct pins of a document and stops
+// replicating it.
+func (s *Server) Unpin(ctx context.Context, in *serverpb.UnpinRequest) (*serverpb.UnpinResponse, error) {
+	found, err := s.removePin(pinKey(in.DocumentId, true), pinKey(in.DocumentId, false))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.Errorf("%s is not pinned", in.DocumentId)
+	}
+	if err := s.dropReplication(ctx, in.DocumentId); err != nil {
+		return nil, err
+	}
+	return &serverpb.UnpinResponse{}, nil
+}
+
+func (s *Server) ListPins(ctx context.Context, in *serverpb.ListPinsRequest) (*serverpb.ListPinsResponse, error) {
+	pins, err := s.pins()
+	if err != nil {
+		return nil, err
+	}
+	resp := &serverpb.ListPinsResponse{}
+	for i := range pins {
+		resp.Pins = append(resp.Pins, &pins[i])
+	}
+	return resp, nil
+}
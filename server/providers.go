@@ -0,0 +1,386 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+const (
+	// providerInterval is how often every local document is announced to
+	// the connected peers.
+	providerInterval = time.Minute
+
+	// providerTTL is how long a provider record is kept without being
+	// announced again.
+	providerTTL = 3 * providerInterval
+
+	// announceBatchSize is the maximum number of document IDs sent in a
+	// single announcement.
+	announceBatchSize = 1024
+
+	// maxProviderRecords is the maximum number of documents recorded for a
+	// single provider.
+	maxProviderRecords = 1 << 16
+)
+
+// providerRecord records that a node announced that it stores a document.
+type providerRecord struct {
+	meta    serverpb.NodeMeta
+	expires time.Time
+}
+
+// addProviders records that the node described by meta stores the documents.
+// Documents past maxProviderRecords for the node are ignored.
+func (s *Server) addProviders(meta serverpb.NodeMeta, ids []string, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		records, ok := s.mu.providers[id]
+		if _, exists := records[meta.Id]; !exists {
+			if s.mu.providerRecords[meta.Id] >= maxProviderRecords {
+				continue
+			}
+			s.mu.providerRecords[meta.Id]++
+		}
+		if !ok {
+			records = map[string]providerRecord{}
+			s.mu.providers[id] = records
+		}
+		records[meta.Id] = providerRecord{meta: meta, expires: expires}
+	}
+}
+
+// expireProviders removes the provider records that weren't announced again
+// in time.
+func (s *Server) expireProviders(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, records := range s.mu.providers {
+		for nodeID, record := range records {
+			if now.After(record.expires) {
+				delete(records, nodeID)
+				s.mu.providerRecords[nodeID]--
+				if s.mu.providerRecords[nodeID] == 0 {
+					delete(s.mu.providerRecords, nodeID)
+				}
+			}
+		}
+		if len(records) == 0 {
+			delete(s.mu.providers, id)
+		}
+	}
+}
+
+// localProviders returns the providers of a document known to this node,
+// including itself if the document is stored locally.
+func (s *Server) localProviders(id string) ([]*serverpb.NodeMeta, error) {
+	var providers []*serverpb.NodeMeta
+	if _, err := s.localDocument(id); err == nil {
+		meta, err := s.NodeMeta()
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, &meta)
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, record := range s.mu.providers[id] {
+		if now.After(record.expires) {
+			continue
+		}
+		meta := record.meta
+		providers = append(providers, &meta)
+	}
+	return providers, nil
+}
+
+// findProviders returns the known providers of a document. If there are none
+// the request is forwarded to the peers that haven't been visited yet until
+// one of them knows a provider. Lookups already forwarded by this node under
+// the same request ID aren't forwarded again.
+func (s *Server) findProviders(ctx context.Context, id string, visited []string, ttl int32, requestID string) ([]*serverpb.NodeMeta, error) {
+	providers, err := s.localProviders(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(providers) > 0 || ttl <= 0 || !s.requests.firstSeen(requestID, time.Now()) {
+		return providers, nil
+	}
+	if s.dhtMode() {
+		return s.dhtFindProviders(ctx, id)
+	}
+
+	req := &serverpb.GetProvidersRequest{
+		DocumentId: id,
+		Visited:    append(append([]string{}, visited...), s.id),
+		Ttl:        ttl - 1,
+		RequestId:  requestID,
+	}
+	for _, peerID := range s.routePeers(id, visited) {
+		s.mu.Lock()
+		client, ok := s.mu.peers[peerID]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		resp, err := client.GetProviders(ctx, req)
+		cancel()
+		if err != nil {
+			s.log.Printf("failed to get providers from %s: %+v", color.RedString(peerID), err)
+			continue
+		}
+		for _, meta := range resp.Providers {
+			if err := validateNodeMeta(*meta); err != nil {
+				s.log.Printf("peer %s returned invalid provider: %+v", color.RedString(peerID), err)
+				continue
+			}
+			providers = append(providers, meta)
+		}
+		if len(providers) > 0 {
+			return providers, nil
+		}
+	}
+	return nil, nil
+}
+
+// queueAnnounce schedules a newly stored document to be announced to the
+// connected peers.
+func (s *Server) queueAnnounce(id string) {
+	s.mu.Lock()
+	s.mu.pendingAnnounce = append(s.mu.pendingAnnounce, id)
+	s.mu.Unlock()
+
+	select {
+	case s.announceC <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleAnnounceTo schedules every local document to be announced to a
+// newly connected peer.
+func (s *Server) scheduleAnnounceTo(nodeID string) {
+	s.mu.Lock()
+	s.mu.announcePeers = append(s.mu.announcePeers, nodeID)
+	s.mu.Unlock()
+
+	select {
+	case s.announceC <- struct{}{}:
+	default:
+	}
+}
+
+// announceLoop announces newly stored documents as they are added and every
+// local document periodically so provider records don't expire.
+func (s *Server) announceLoop() {
+	ctx, cancel := s.stopContext()
+	defer cancel()
+
+	ticker := time.NewTicker(providerInterval)
+	defer ticker.Stop()
+	for {
+		all := false
+		select {
+		case <-s.stopper:
+			return
+		case <-s.announceC:
+		case now := <-ticker.C:
+			s.expireProviders(now)
+			all = true
+		}
+
+		if err := s.announceQueued(ctx, all); err != nil {
+			s.log.Printf("announce error: %+v", err)
+		}
+	}
+}
+
+// announceQueued announces the queued documents, and every local document to
+// the peers it was scheduled for, or to every peer if all is set.
+func (s *Server) announceQueued(ctx context.Context, all bool) error {
+	s.mu.Lock()
+	ids := s.mu.pendingAnnounce
+	newPeers := s.mu.announcePeers
+	s.mu.pendingAnnounce = nil
+	s.mu.announcePeers = nil
+	s.mu.Unlock()
+
+	var local []string
+	if all || len(newPeers) > 0 {
+		s.gcMu.RLock()
+		if s.stopped() {
+			s.gcMu.RUnlock()
+			return nil
+		}
+		var err error
+		local, err = s.localDocumentIDs()
+		s.gcMu.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if all {
+		return s.announce(ctx, local)
+	}
+	if len(newPeers) > 0 {
+		s.mu.Lock()
+		peers := map[string]serverpb.NodeClient{}
+		for _, nodeID := range newPeers {
+			if client, ok := s.mu.peers[nodeID]; ok {
+				peers[nodeID] = client
+			}
+		}
+		s.mu.Unlock()
+		if err := s.announceTo(ctx, peers, local); err != nil {
+			return err
+		}
+	}
+	return s.announce(ctx, ids)
+}
+
+// announce sends provider records for the documents to every connected peer,
+// or to the nodes closest to each document in DHT mode.
+func (s *Server) announce(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if s.dhtMode() {
+		return s.dhtProvide(ctx, ids)
+	}
+
+	s.mu.Lock()
+	peers := map[string]serverpb.NodeClient{}
+	for nodeID, client := range s.mu.peers {
+		peers[nodeID] = client
+	}
+	s.mu.Unlock()
+	return s.announceTo(ctx, peers, ids)
+}
+
+// announceTo sends provider records for the documents to the peers.
+func (s *Server) announceTo(ctx context.Context, peers map[string]serverpb.NodeClient, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	meta, err := s.NodeMeta()
+	if err != nil {
+		return err
+	}
+
+	for nodeID, client := range peers {
+		for i := 0; i < len(ids); i += announceBatchSize {
+			end := i + announceBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			req, err := s.signAddProviders(serverpb.AddProvidersRequest{
+				Provider:    &meta,
+				DocumentIds: ids[i:end],
+				Timestamp:   time.Now().Unix(),
+			})
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			_, err = client.AddProviders(ctx, req)
+			cancel()
+			if err != nil {
+				s.log.Printf("failed to announce to %s: %+v", color.RedString(nodeID), err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// addProvidersHash returns the hash of an announcement signed by the
+// provider.
+func addProvidersHash(req serverpb.AddProvidersRequest) ([]byte, error) {
+	req.Signature = ""
+	body, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(body)
+	return hash[:], nil
+}
+
+// signAddProviders signs an announcement of this node's documents.
+func (s *Server) signAddProviders(req serverpb.AddProvidersRequest) (*serverpb.AddProvidersRequest, error) {
+	hash, err := addProvidersHash(req)
+	if err != nil {
+		return nil, err
+	}
+	req.Signature, err = signHash(hash, s.key)
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// AddProviders records the documents a peer announced it stores. The
+// announcement must be signed by the provider within providerInterval.
+func (s *Server) AddProviders(ctx context.Context, in *serverpb.AddProvidersRequest) (*serverpb.AddProvidersResponse, error) {
+	if in.Provider == nil {
+		return nil, errors.New("missing provider")
+	}
+	if len(in.DocumentIds) > announceBatchSize {
+		return nil, errors.Errorf("announced %d documents; at most %d are accepted", len(in.DocumentIds), announceBatchSize)
+	}
+	if err := validateNodeMeta(*in.Provider); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if signed := time.Unix(in.Timestamp, 0); signed.Before(now.Add(-providerInterval)) || signed.After(now.Add(providerInterval)) {
+		return nil, errors.Errorf("announcement signed at %s", signed)
+	}
+	hash, err := addProvidersHash(*in)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyHash(*in.Provider, hash, in.Signature); err != nil {
+		return nil, err
+	}
+	s.addProviders(*in.Provider, in.DocumentIds, now.Add(providerTTL))
+	return &serverpb.AddProvidersResponse{}, nil
+}
+
+// GetProviders returns the providers of a document to a peer, forwarding the
+// request to our own peers if none are known.
+func (s *Server) GetProviders(ctx context.Context, in *serverpb.GetProvidersRequest) (*serverpb.GetProvidersResponse, error) {
+	providers, err := s.findProviders(ctx, in.DocumentId, in.Visited, in.Ttl, in.RequestId)
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.GetProvidersResponse{
+		Providers: providers,
+	}, nil
+}
+
+// FindProviders returns the nodes that store a document.
+func (s *Server) FindProviders(ctx context.Context, in *serverpb.FindProvidersRequest) (*serverpb.FindProvidersResponse, error) {
+	providers, err := s.findProviders(ctx, in.DocumentId, nil, documentTTL, newRequestID())
+	if err != nil {
+		return nil, err
+	}
+	resp := &serverpb.FindProvidersResponse{}
+	seen := map[string]bool{}
+	for _, meta := range providers {
+		if !seen[meta.Id] {
+			seen[meta.Id] = true
+			resp.Providers = append(resp.Providers, meta)
+		}
+	}
+	return resp, nil
+}
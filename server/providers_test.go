@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+	"time"
+)
+
+func TestProviderRecords(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	local, err := s.storeDocument(serverpb.Document{Data: []byte("local")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	s.addProviders(serverpb.NodeMeta{Id: "a"}, []string{"doc1", "doc2"}, now.Add(time.Minute))
+	s.addProviders(serverpb.NodeMeta{Id: "b"}, []string{"doc1"}, now.Add(-time.Second))
+
+	ids := func(id string) map[string]bool {
+		resp, err := s.FindProviders(ctx, &serverpb.FindProvidersRequest{DocumentId: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]bool{}
+		for _, meta := range resp.Providers {
+			ids[meta.Id] = true
+		}
+		return ids
+	}
+
+	// Expired records are ignored.
+	if got := ids("doc1"); len(got) != 1 || !got["a"] {
+		t.Fatalf("expected provider a; got %v", got)
+	}
+	if got := ids(local); len(got) != 1 || !got[s.id] {
+		t.Fatalf("expected the local node to provide %s; got %v", local, got)
+	}
+	if got := ids("missing"); len(got) != 0 {
+		t.Fatalf("expected no providers; got %v", got)
+	}
+
+	s.expireProviders(now)
+	s.mu.Lock()
+	records := len(s.mu.providers["doc1"])
+	s.mu.Unlock()
+	if records != 1 {
+		t.Fatalf("expected 1 record after expiry; got %d", records)
+	}
+
+	s.expireProviders(now.Add(2 * time.Minute))
+	s.mu.Lock()
+	remaining := len(s.mu.providers)
+	s.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("expected every record to expire; %d documents left", remaining)
+	}
+}
+
+func TestAddProvidersSigned(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+	provider, stopProvider := newTestServer(t)
+	defer stopProvider()
+
+	ctx := context.Background()
+	meta, err := provider.NodeMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Addrs = []string{"127.0.0.1:1"}
+	meta.Signature, err = nodeMetaSign(meta, provider.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	announce := func(ids []string, timestamp time.Time) *serverpb.AddProvidersRequest {
+		req, err := provider.signAddProviders(serverpb.AddProvidersRequest{
+			Provider:    &meta,
+			DocumentIds: ids,
+			Timestamp:   timestamp.Unix(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	if _, err := s.AddProviders(ctx, announce([]string{"doc1"}, time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests altered after signing are rejected.
+	forged := announce([]string{"doc2"}, time.Now())
+	forged.DocumentIds = []string{"doc3"}
+	if _, err := s.AddProviders(ctx, forged); err == nil {
+		t.Fatal("expected altered announcement to be rejected")
+	}
+	stale := announce([]string{"doc2"}, time.Now().Add(-2*providerInterval))
+	if _, err := s.AddProviders(ctx, stale); err == nil {
+		t.Fatal("expected stale announcement to be rejected")
+	}
+	oversized := announce(make([]string, announceBatchSize+1), time.Now())
+	if _, err := s.AddProviders(ctx, oversized); err == nil {
+		t.Fatal("expected oversized announcement to be rejected")
+	}
+
+	s.mu.Lock()
+	n := len(s.mu.providers)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 announced document; got %d", n)
+	}
+}
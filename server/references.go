@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+const (
+	referencePrefix = "/reference/"
+
+	// Prefixes of the records stored in references.
+	documentRecordPrefix  = "document:"
+	referenceRecordPrefix = "reference:"
+
+	// maxReferenceDepth is the maximum number of references followed when
+	// resolving a reference, to guard against cycles.
+	maxReferenceDepth = 8
+
+	// referenceRefreshInterval is the minimum time between looking up newer
+	// versions of a reference stored locally.
+	referenceRefreshInterval = 30 * time.Second
+)
+
+var ErrReferenceNotFound = errors.New("reference not found")
+
+func referenceKey(id string) []byte {
+	return []byte(referencePrefix + id)
+}
+
+// loadReferences reads the stored references into memory, skipping any that
+// can't be decoded or fail validation.
+func (s *Server) loadReferences() error {
+	references := map[string]serverpb.Reference{}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(referencePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			id := strings.TrimPrefix(string(it.Item().Key()), referencePrefix)
+			body, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var ref serverpb.Reference
+			if err := ref.Unmarshal(body); err != nil {
+				s.log.Printf("skipping stored reference %s: %+v", id, err)
+				continue
+			}
+			if err := verifyReference(id, ref); err != nil {
+				s.log.Printf("skipping stored reference: %+v", err)
+				continue
+			}
+			references[id] = ref
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, ref := range references {
+		s.mu.references[id] = ref
+	}
+	return nil
+}
+
+// resolveReference follows a chain of references until it reaches a document
+// record, returning the document path it points to.
+func (s *Server) resolveReference(ctx context.Context, id string) (string, error) {
+	for i := 0; i < maxReferenceDepth; i++ {
+		resp, err := s.GetReference(ctx, &serverpb.GetReferenceRequest{
+			ReferenceId: id,
+		})
+		if err != nil {
+			return "", err
+		}
+		if resp.Reference == nil {
+			return "", errors.Wrapf(ErrReferenceNotFound, "%s", id)
+		}
+		value := resp.Reference.Value
+		switch {
+		case strings.HasPrefix(value, documentRecordPrefix):
+			return strings.TrimPrefix(value, documentRecordPrefix), nil
+		case strings.HasPrefix(value, referenceRecordPrefix):
+			id = strings.TrimPrefix(value, referenceRecordPrefix)
+		default:
+			return "", errors.Errorf("reference %s has invalid record %q", id, value)
+		}
+	}
+	return "", errors.Errorf("reference %s: too many levels of indirection", id)
+}
+
+// validateReference checks that a reference was signed by the private key of
+// its public key.
+func validateReference(ref serverpb.Reference) error {
+	if ref.PublicKey == "" {
+		return errors.New("reference missing PublicKey")
+	}
+	if ref.Signature == "" {
+		return errors.New("reference missing Signature")
+	}
+	publicKey, err := UnmarshalPublic(ref.PublicKey)
+	if err != nil {
+		return err
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(ref.Signature)
+	if err != nil {
+		return err
+	}
+	var sig EcdsaSignature
+	if _, err := asn1.Unmarshal(rawSig, &sig); err != nil {
+		return err
+	}
+
+	digest, err := referenceDigest(ref)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.Verify(publicKey, digest, sig.R, sig.S) {
+		return errors.New("reference has invalid Signature")
+	}
+	return nil
+}
+
+// referenceDigest returns the digest signed by the owner of a reference: the
+// SHA-256 hash of the reference without its signature. ECDSA only uses as
+// many bytes of the signed message as the curve order has, so the reference
+// is hashed for the signature to cover all of it.
+func referenceDigest(ref serverpb.Reference) ([]byte, error) {
+	ref.Signature = ""
+	body, err := ref.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(body)
+	return digest[:], nil
+}
+
+// verifyReference checks that a reference is valid and is stored under id.
+func verifyReference(id string, ref serverpb.Reference) error {
+	if err := validateReference(ref); err != nil {
+		return errors.Wrapf(err, "reference %s", id)
+	}
+	refID, err := Hash(ref.PublicKey)
+	if err != nil {
+		return err
+	}
+	if refID != id {
+		return errors.Errorf("expected reference %s; got %s", id, refID)
+	}
+	return nil
+}
+
+// newerReference returns whether a should replace b: it has a higher
+// timestamp, with ties broken by signature so every node keeps the same one.
+func newerReference(a, b serverpb.Reference) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp > b.Timestamp
+	}
+	return a.Signature > b.Signature
+}
+
+// storeReference validates a reference and persists it unless a newer version
+// is stored under its ID. It returns whether the reference was stored.
+func (s *Server) storeReference(ref serverpb.Reference) (bool, error) {
+	if err := validateReference(ref); err != nil {
+		return false, err
+	}
+	id, err := Hash(ref.PublicKey)
+	if err != nil {
+		return false, err
+	}
+	body, err := ref.Marshal()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	existing, ok := s.mu.references[id]
+	s.mu.Unlock()
+	if ok && !newerReference(ref, existing) {
+		return false, nil
+	}
+
+	// The write isn't made under s.mu, so compare against the stored version
+	// in the same transaction in case a newer one was stored concurrently.
+	for {
+		var stored bool
+		err := s.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(referenceKey(id))
+			if err == nil {
+				value, err := item.Value()
+				if err != nil {
+					return err
+				}
+				var current serverpb.Reference
+				if err := current.Unmarshal(value); err == nil && validateReference(current) == nil && !newerReference(ref, current) {
+					return nil
+				}
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			stored = true
+			return txn.Set(referenceKey(id), body)
+		})
+		if err == badger.ErrConflict {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if !stored {
+			return false, nil
+		}
+		break
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.mu.references[id]; ok && !newerReference(ref, existing) {
+		return false, nil
+	}
+	s.mu.references[id] = ref
+	return true, nil
+}
+
+// publishReference pushes a reference to the connected peers that haven't
+// received it yet.
+func (s *Server) publishReference(ctx context.Context, ref serverpb.Reference, visited []string, ttl int32) {
+	if ttl <= 0 {
+		return
+	}
+	req := &serverpb.PublishReferenceRequest{
+		Reference: &ref,
+		Visited:   append(append([]string{}, visited...), s.id),
+		Ttl:       ttl - 1,
+	}
+	for nodeID, client := range s.unvisitedPeers(visited) {
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		_, err := client.PublishReference(ctx, req)
+		cancel()
+		if err != nil {
+			s.log.Printf("failed to publish reference to %s: %+v", color.RedString(nodeID), err)
+		}
+	}
+}
+
+// findReference returns the newest version of a reference known to this node.
+// If there is a local version it is returned right away and refreshed from
+// the network in the background, at most once per referenceRefreshInterval;
+// otherwise the network is searched. Lookups already forwarded by this node
+// under the same request ID only return the local version.
+func (s *Server) findReference(ctx context.Context, id string, visited []string, ttl int32, requestID string) (*serverpb.Reference, error) {
+	found := s.localReference(id)
+	if ttl <= 0 || !s.requests.firstSeen(requestID, time.Now()) {
+		return found, nil
+	}
+	if found == nil {
+		return s.lookupReference(ctx, id, visited, ttl, requestID)
+	}
+	if s.refreshDue(id, time.Now()) {
+		go func() {
+			ctx, cancel := s.stopContext()
+			defer cancel()
+			if _, err := s.lookupReference(ctx, id, visited, ttl, requestID); err != nil {
+				s.log.Printf("failed to refresh reference %s: %+v", id, err)
+			}
+		}()
+	}
+	return found, nil
+}
+
+// localReference returns the version of a reference stored locally, if any.
+func (s *Server) localReference(id string) *serverpb.Reference {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if reference, ok := s.mu.references[id]; ok {
+		return &reference
+	}
+	return nil
+}
+
+// refreshDue returns whether the local version of a reference should be
+// refreshed from the network and records the refresh.
+func (s *Server) refreshDue(id string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.mu.referenceRefreshes[id]) < referenceRefreshInterval {
+		return false
+	}
+	s.mu.referenceRefreshes[id] = now
+	return true
+}
+
+// lookupReference searches the network for a reference, querying every
+// unvisited peer at once, and stores the newest version found. It returns the
+// newest version now known to this node.
+func (s *Server) lookupReference(ctx context.Context, id string, visited []string, ttl int32, requestID string) (*serverpb.Reference, error) {
+	var remote *serverpb.Reference
+	if s.dhtMode() {
+		var err error
+		remote, err = s.dhtGetReference(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req := &serverpb.FindReferenceRequest{
+			ReferenceId: id,
+			Visited:     append(append([]string{}, visited...), s.id),
+			Ttl:         ttl - 1,
+			RequestId:   requestID,
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for nodeID, client := range s.unvisitedPeers(visited) {
+			wg.Add(1)
+			go func(nodeID string, client serverpb.NodeClient) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+				resp, err := client.FindReference(ctx, req)
+				cancel()
+				if err != nil {
+					s.log.Printf("failed to find reference on %s: %+v", color.RedString(nodeID), err)
+					return
+				}
+				if resp.Reference == nil {
+					return
+				}
+				if err := verifyReference(id, *resp.Reference); err != nil {
+					s.log.Printf("peer %s returned invalid reference: %+v", color.RedString(nodeID), err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if remote == nil || newerReference(*resp.Reference, *remote) {
+					remote = resp.Reference
+				}
+			}(nodeID, client)
+		}
+		wg.Wait()
+	}
+	if remote != nil {
+		if _, err := s.storeReference(*remote); err != nil {
+			return nil, err
+		}
+	}
+	return s.localReference(id), nil
+}
+
+// unvisitedPeers returns the clients of the connected peers that aren't in
+// visited.
+func (s *Server) unvisitedPeers(visited []string) map[string]serverpb.NodeClient {
+	skip := map[string]bool{}
+	for _, nodeID := range visited {
+		skip[nodeID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := map[string]serverpb.NodeClient{}
+	for nodeID, client := range s.mu.peers {
+		if !skip[nodeID] {
+			peers[nodeID] = client
+		}
+	}
+	return peers
+}
+
+// PublishReference stores a reference pushed by a peer and forwards it to our
+// own peers if it is newer than the version we had.
+func (s *Server) PublishReference(ctx context.Context, in *serverpb.PublishReferenceRequest) (*serverpb.PublishReferenceResponse, error) {
+	if in.Reference == nil {
+		return nil, errors.New("missing reference")
+	}
+	stored, err := s.storeReference(*in.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if stored {
+		// Forward in the background so the publisher doesn't wait for the
+		// whole network.
+		go func() {
+			ctx, cancel := s.stopContext()
+			defer cancel()
+			s.publishReference(ctx, *in.Reference, in.Visited, in.Ttl)
+		}()
+	}
+	return &serverpb.PublishReferenceResponse{}, nil
+}
+
+// FindReference returns a reference to a peer, looking for newer versions on
+// our own peers.
+func (s *Server) FindReference(ctx context.Context, in *serverpb.FindReferenceRequest) (*serverpb.FindReferenceResponse, error) {
+	reference, err := s.findReference(ctx, in.ReferenceId, in.Visited, in.Ttl, in.RequestId)
+	if err != nil {
+		return nil, err
+	}
+	return &serverpb.FindReferenceResponse{
+		Reference: reference,
+	}, nil
+}
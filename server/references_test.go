@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestStoreReference(t *testing.T) {
+	s, stop := newTestServer(t)
+	defer stop()
+
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(record string) serverpb.Reference {
+		resp, err := s.AddReference(ctx, &serverpb.AddReferenceRequest{
+			PrivKey: pem.EncodeToMemory(pemBlockForKey(key)),
+			Record:  record,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.mu.references[resp.ReferenceId]
+	}
+
+	v1 := publish("document:v1")
+	v2 := publish("document:v2")
+	if v2.Timestamp <= v1.Timestamp {
+		t.Fatalf("expected v2 to be newer than v1; got %d <= %d", v2.Timestamp, v1.Timestamp)
+	}
+	id, err := Hash(v1.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyReference(id, v1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older versions are ignored.
+	stored, err := s.storeReference(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored {
+		t.Fatal("expected older reference to be ignored")
+	}
+	resp, err := s.GetReference(ctx, &serverpb.GetReferenceRequest{ReferenceId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Reference.Value != "document:v2" {
+		t.Fatalf("expected v2; got %q", resp.Reference.Value)
+	}
+
+	// Tampered references are rejected.
+	forged := v2
+	forged.Value = "document:forged"
+	forged.Timestamp++
+	if _, err := s.storeReference(forged); err == nil {
+		t.Fatal("expected forged reference to be rejected")
+	}
+	// The signature covers the fields after the first 32 bytes of the
+	// reference too.
+	replayed := v2
+	replayed.Timestamp++
+	if err := validateReference(replayed); err == nil {
+		t.Fatal("expected reference with a changed timestamp to be rejected")
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := MarshalPublic(&other.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stolen := v2
+	stolen.PublicKey = otherKey
+	if _, err := s.storeReference(stolen); err == nil {
+		t.Fatal("expected reference signed by another key to be rejected")
+	}
+	if err := verifyReference("wrong", v2); err == nil {
+		t.Fatal("expected reference under the wrong ID to be rejected")
+	}
+}
+
+func TestReferencesPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfs-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := serverpb.NodeConfig{
+		Path: dir,
+	}
+	s, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	for _, record := range []string{"document:v1", "document:v2"} {
+		resp, err := s.AddReference(ctx, &serverpb.AddReferenceRequest{
+			PrivKey: pem.EncodeToMemory(pemBlockForKey(key)),
+			Record:  record,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id = resp.ReferenceId
+	}
+
+	reopen := func() {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		s, err = New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	reopen()
+	resp, err := s.GetReference(ctx, &serverpb.GetReferenceRequest{ReferenceId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Reference == nil || resp.Reference.Value != "document:v2" {
+		t.Fatalf("expected v2 to be restored; got %+v", resp.Reference)
+	}
+
+	// Records that fail validation are skipped when loading.
+	forged := *resp.Reference
+	forged.Value = "document:forged"
+	body, err := forged.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(referenceKey(id), body)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	s.mu.Lock()
+	n := len(s.mu.references)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected forged reference to be skipped; got %d references", n)
+	}
+
+	// So are records that can't be decoded.
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(referenceKey(id), []byte{0xff})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	s.mu.Lock()
+	n = len(s.mu.references)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected corrupt reference to be skipped; got %d references", n)
+	}
+}
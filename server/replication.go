@@ -0,0 +1,402 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+const (
+	replicationPrefix = "/replication/"
+
+	// replicationInterval is how often under-replicated documents are
+	// checked for peers to replicate them to, in addition to whenever a
+	// document is added or a peer connects or goes away.
+	replicationInterval = 30 * time.Second
+
+	// replicateTimeout bounds how long a peer may take to fetch a document.
+	replicateTimeout = time.Minute
+)
+
+func replicationKey(id string) []byte {
+	return []byte(replicationPrefix + id)
+}
+
+// getReplication returns the replication record of a document. It returns
+// badger.ErrKeyNotFound if the document isn't replicated.
+func (s *Server) getReplication(id string) (serverpb.Replication, error) {
+	var rep serverpb.Replication
+	if err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(replicationKey(id))
+		if err != nil {
+			return err
+		}
+		body, err := item.Value()
+		if err != nil {
+			return err
+		}
+		return rep.Unmarshal(body)
+	}); err != nil {
+		return serverpb.Replication{}, err
+	}
+	return rep, nil
+}
+
+func (s *Server) putReplication(rep serverpb.Replication) error {
+	body, err := rep.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(replicationKey(rep.DocumentId), body)
+	})
+}
+
+// replications returns every replication record.
+func (s *Server) replications() ([]serverpb.Replication, error) {
+	var reps []serverpb.Replication
+	if err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(replicationPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			body, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var rep serverpb.Replication
+			if err := rep.Unmarshal(body); err != nil {
+				return err
+			}
+			reps = append(reps, rep)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return reps, nil
+}
+
+// replicationFactor returns the number of peers to replicate a document to,
+// given the factor requested when adding it.
+func (s *Server) replicationFactor(requested int32) int32 {
+	if requested > 0 {
+		return requested
+	}
+	return s.config.ReplicationFactor
+}
+
+// setReplicationFactor records that a document should be replicated to factor
+// peers and schedules the replication.
+func (s *Server) setReplicationFactor(id string, factor int32) error {
+	if factor <= 0 {
+		return nil
+	}
+
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	rep, err := s.getReplication(id)
+	if err == badger.ErrKeyNotFound {
+		rep = serverpb.Replication{DocumentId: id}
+	} else if err != nil {
+		return err
+	}
+	rep.Factor = factor
+	if err := s.putReplication(rep); err != nil {
+		return err
+	}
+	s.scheduleReplication()
+	return nil
+}
+
+// replicateImported records that an imported document should be replicated to
+// the node's replication_factor peers.
+func (s *Server) replicateImported(id string) error {
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	if s.stopped() {
+		return ErrStopped
+	}
+	return s.setReplicationFactor(id, s.replicationFactor(0))
+}
+
+// dropReplication removes the replication record of a document the node no
+// longer pins recursively and asks the holders to release their replicas.
+func (s *Server) dropReplication(ctx context.Context, id string) error {
+	s.gcMu.RLock()
+	if s.stopped() {
+		s.gcMu.RUnlock()
+		return nil
+	}
+	rep, err := s.removeReplication(id)
+	s.gcMu.RUnlock()
+	if err != nil || rep == nil {
+		return err
+	}
+
+	s.mu.Lock()
+	peers := map[string]serverpb.NodeClient{}
+	for _, holder := range rep.Holders {
+		if client, ok := s.mu.peers[holder]; ok {
+			peers[holder] = client
+		}
+	}
+	s.mu.Unlock()
+
+	req := &serverpb.ReplicateRequest{
+		DocumentId: id,
+		Origin:     s.id,
+		Release:    true,
+	}
+	for nodeID, client := range peers {
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		_, err := client.Replicate(ctx, req)
+		cancel()
+		if err != nil {
+			s.log.Printf("failed to release replica of %s on %s: %+v", id, color.RedString(nodeID), err)
+		}
+	}
+	return nil
+}
+
+// removeReplication deletes the replication record of a document unless the
+// node pins it recursively, and returns the deleted record, if any. The
+// caller must hold gcMu.
+func (s *Server) removeReplication(id string) (*serverpb.Replication, error) {
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	if pinned, err := s.pinnedRecursively(id); err != nil || pinned {
+		return nil, err
+	}
+	rep, err := s.getReplication(id)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(replicationKey(id))
+	}); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// removeReplicaHolder forgets a peer that went away as a holder of every
+// document and schedules re-replication.
+func (s *Server) removeReplicaHolder(nodeID string) error {
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+
+	if s.stopped() {
+		// Peers go away when shutting down.
+		return nil
+	}
+
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	reps, err := s.replications()
+	if err != nil {
+		return err
+	}
+	var removed bool
+	for _, rep := range reps {
+		var holders []string
+		for _, holder := range rep.Holders {
+			if holder != nodeID {
+				holders = append(holders, holder)
+			}
+		}
+		if len(holders) == len(rep.Holders) {
+			continue
+		}
+		rep.Holders = holders
+		if err := s.putReplication(rep); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if removed {
+		s.scheduleReplication()
+	}
+	return nil
+}
+
+func (s *Server) scheduleReplication() {
+	select {
+	case s.replicateC <- struct{}{}:
+	default:
+	}
+}
+
+// replicateLoop replicates under-replicated documents whenever replication is
+// scheduled and periodically in case new peers are available.
+func (s *Server) replicateLoop() {
+	ctx, cancel := s.stopContext()
+	defer cancel()
+
+	ticker := time.NewTicker(replicationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper:
+			return
+		case <-s.replicateC:
+		case <-ticker.C:
+		}
+		if err := s.replicate(ctx); err != nil {
+			s.log.Printf("replication error: %+v", err)
+		}
+	}
+}
+
+// replicate asks connected peers to store every document that has fewer
+// holders than its replication factor. Documents that are no longer pinned,
+// such as ones unpinned while the node was down, stop being replicated.
+func (s *Server) replicate(ctx context.Context) error {
+	s.gcMu.RLock()
+	if s.stopped() {
+		s.gcMu.RUnlock()
+		return nil
+	}
+	reps, err := s.replications()
+	unpinned := map[string]bool{}
+	for _, rep := range reps {
+		if err != nil {
+			break
+		}
+		var pinned bool
+		pinned, err = s.pinnedRecursively(rep.DocumentId)
+		unpinned[rep.DocumentId] = !pinned
+	}
+	s.gcMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, rep := range reps {
+		if unpinned[rep.DocumentId] {
+			if err := s.dropReplication(ctx, rep.DocumentId); err != nil {
+				return err
+			}
+			continue
+		}
+		if int32(len(rep.Holders)) >= rep.Factor {
+			continue
+		}
+		if err := s.replicateDocument(ctx, rep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicateDocument adds connected peers that aren't holders yet to a
+// document until it reaches its replication factor or runs out of peers.
+func (s *Server) replicateDocument(ctx context.Context, rep serverpb.Replication) error {
+	holders := map[string]bool{}
+	for _, holder := range rep.Holders {
+		holders[holder] = true
+	}
+
+	s.mu.Lock()
+	peers := map[string]serverpb.NodeClient{}
+	var candidates []string
+	for nodeID, client := range s.mu.peers {
+		if !holders[nodeID] {
+			peers[nodeID] = client
+			candidates = append(candidates, nodeID)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(candidates)
+
+	var added []string
+	for _, nodeID := range candidates {
+		if len(rep.Holders)+len(added) >= int(rep.Factor) {
+			break
+		}
+		ctx, cancel := context.WithTimeout(ctx, replicateTimeout)
+		_, err := peers[nodeID].Replicate(ctx, &serverpb.ReplicateRequest{
+			DocumentId: rep.DocumentId,
+			Origin:     s.id,
+		})
+		cancel()
+		if err != nil {
+			s.log.Printf("failed to replicate %s to %s: %+v", rep.DocumentId, color.RedString(nodeID), err)
+			continue
+		}
+		added = append(added, nodeID)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	if s.stopped() {
+		return nil
+	}
+
+	// Holders may have been removed while the peers were fetching the
+	// document.
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	current, err := s.getReplication(rep.DocumentId)
+	if err != nil {
+		return err
+	}
+	current.Holders = append(current.Holders, added...)
+	return s.putReplication(current)
+}
+
+// Replicate fetches and pins a document and everything linked from it on
+// behalf of a peer, or releases the pin once the peer stops replicating it.
+// The pin is a replica pin, see replicaPinKey.
+func (s *Server) Replicate(ctx context.Context, in *serverpb.ReplicateRequest) (*serverpb.ReplicateResponse, error) {
+	if in.Origin == "" {
+		return nil, errors.New("missing origin")
+	}
+	key := replicaPinKey(in.DocumentId, in.Origin)
+	if in.Release {
+		if _, err := s.removePin(key); err != nil {
+			return nil, err
+		}
+		return &serverpb.ReplicateResponse{}, nil
+	}
+
+	pin := serverpb.Pin{
+		DocumentId: in.DocumentId,
+		Recursive:  true,
+		Origin:     in.Origin,
+	}
+	value, err := pin.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fetchPinned(ctx, in.DocumentId, true, key, value); err != nil {
+		return nil, err
+	}
+	return &serverpb.ReplicateResponse{}, nil
+}
+
+// Replicas returns the replication record of a document added to this node.
+func (s *Server) Replicas(ctx context.Context, in *serverpb.ReplicasRequest) (*serverpb.ReplicasResponse, error) {
+	rep, err := s.getReplication(in.DocumentId)
+	if err == badger.ErrKeyNotFound {
+		return nil, errors.Errorf("%s isn't replicated", in.DocumentId)
+	} else if err != nil {
+		return nil, err
+	}
+	return &serverpb.ReplicasResponse{
+		Replication: &rep,
+	}, nil
+}
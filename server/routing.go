@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sync"
+	"time"
+)
+
+// requestTTL is how long the ID of a forwarded request is remembered.
+const requestTTL = time.Minute
+
+// newRequestID returns a random ID for a lookup forwarded through the network.
+func newRequestID() string {
+	var b [16]byte
+	// crypto/rand only fails if the system has no entropy source.
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestCache remembers the IDs of recently handled lookups so a lookup
+// reaching a node through several paths is only forwarded once.
+type requestCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newRequestCache() *requestCache {
+	return &requestCache{
+		seen: map[string]time.Time{},
+	}
+}
+
+// firstSeen records a request ID and returns whether it wasn't seen within
+// requestTTL. Requests without an ID are always handled.
+func (c *requestCache) firstSeen(id string, now time.Time) bool {
+	if id == "" {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > requestTTL {
+		for seenID, expires := range c.seen {
+			if now.After(expires) {
+				delete(c.seen, seenID)
+			}
+		}
+		c.lastSweep = now
+	}
+	if expires, ok := c.seen[id]; ok && now.Before(expires) {
+		return false
+	}
+	c.seen[id] = now.Add(requestTTL)
+	return true
+}
+
+// loadRoutingTable adds every document in the local store to the routing
+// table.
+func (s *Server) loadRoutingTable() error {
+	ids, err := s.localDocumentIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		s.rt.AddLocal(id)
+	}
+	return nil
+}
+
+// BloomFilters returns the attenuated bloom filter this node advertises to the
+// requesting peer.
+func (s *Server) BloomFilters(ctx context.Context, req *serverpb.BloomFiltersRequest) (*serverpb.BloomFiltersResponse, error) {
+	resp := &serverpb.BloomFiltersResponse{}
+	for _, bf := range s.rt.Filters(req.NodeId) {
+		resp.Filters = append(resp.Filters, bf.Proto())
+	}
+	return resp, nil
+}
+
+// updateRoutes fetches the bloom filters advertised by a peer and stores them
+// in the routing table.
+func (s *Server) updateRoutes(ctx context.Context, nodeID string, client serverpb.NodeClient) error {
+	resp, err := client.BloomFilters(ctx, &serverpb.BloomFiltersRequest{
+		NodeId: s.id,
+	})
+	if err != nil {
+		return err
+	}
+	var filters []*BloomFilter
+	for _, pb := range resp.Filters {
+		bf, err := BloomFilterFromProto(pb)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, bf)
+	}
+	return s.rt.UpdateEntry(nodeID, filters)
+}
+
+// routePeers returns the connected peers that haven't been visited yet. Peers
+// whose bloom filters match the document come first, ordered by hop count,
+// followed by the rest since the filters may be out of date.
+func (s *Server) routePeers(id string, visited []string) []string {
+	skip := map[string]bool{s.id: true}
+	for _, v := range visited {
+		skip[v] = true
+	}
+
+	var peers []string
+	for _, nodeID := range s.rt.Route(id) {
+		if !skip[nodeID] {
+			peers = append(peers, nodeID)
+			skip[nodeID] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for nodeID := range s.mu.peers {
+		if !skip[nodeID] {
+			peers = append(peers, nodeID)
+		}
+	}
+	return peers
+}
@@ -1,32 +1,151 @@
 package server
 
 import (
-  "google.golang.org/grpc"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// routingDepth is the number of hops tracked by the attenuated bloom
+	// filters.
+	routingDepth = 3
+
+	// The routing bloom filters are sized to hold expectedDocuments with the
+	// target false positive rate.
+	expectedDocuments = 4096
+	falsePositiveRate = 0.01
 )
 
+// RoutingTable is an attenuated bloom filter routing table. For every peer it
+// keeps one bloom filter per hop: filter i of a peer contains the documents
+// that are stored i hops away from that peer.
 type RoutingTable struct {
-  unionizedEntries  []BloomFilter,         // Union of bloom filters for every i
-  bloomFilterMap    map[string]BloomFilter // Bloom filter map with key as the node meta id
+	mu sync.Mutex
+
+	depth          int
+	size           uint
+	numHashFuncs   uint
+	local          *CountingBloomFilter      // Documents stored on this node
+	bloomFilterMap map[string][]*BloomFilter // Bloom filters with key as the node meta id
 }
 
-func NewRT() *RoutingTable {
-  routingTable := RoutingTable{
-    unionizedEntries: make([]BloomFilter)
-    bloomFilterMap: make(map[string]BloomFilter)
-  }
-  return &routingTable
+func NewRT(depth int, size, numHashFuncs uint) *RoutingTable {
+	routingTable := RoutingTable{
+		depth:          depth,
+		size:           size,
+		numHashFuncs:   numHashFuncs,
+		local:          NewCBF(size, numHashFuncs),
+		bloomFilterMap: make(map[string][]*BloomFilter),
+	}
+	return &routingTable
 }
 
-func (rt *RoutingTable) AddEntry(bf BloomFilter) {
-  // Add a new entry to the routing table
-  rt.unionizedEntries = append(rt.unionizedEntries, bf)
+// AddLocal records that a document is stored on this node.
+func (rt *RoutingTable) AddLocal(id string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.local.Add([]byte(id))
 }
 
-func (rt *RoutingTable) UpdateEntry(bf BloomFilter, i int) {
-  // Updae an entry to the routing table.
-  rt.unionizedEntries[i] = bf
+// RemoveLocal records that a document is no longer stored on this node. It
+// must only be called for documents previously passed to AddLocal.
+func (rt *RoutingTable) RemoveLocal(id string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.local.Remove([]byte(id))
 }
 
-func (rt * RoutingTable) UnionBloomFilters(num_hops uint64) {
-  // Get the union of all bloom filters num_hops away
-}
\ No newline at end of file
+// UpdateEntry replaces the filters advertised by a peer.
+func (rt *RoutingTable) UpdateEntry(nodeID string, filters []*BloomFilter) error {
+	if len(filters) > rt.depth {
+		filters = filters[:rt.depth]
+	}
+	for _, bf := range filters {
+		if bf.m != rt.size || bf.k != rt.numHashFuncs {
+			return errors.Errorf("bloom filter from %s: expected m=%d k=%d; got m=%d k=%d", nodeID, rt.size, rt.numHashFuncs, bf.m, bf.k)
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.bloomFilterMap[nodeID] = filters
+	return nil
+}
+
+// RemoveEntry removes a peer from the routing table.
+func (rt *RoutingTable) RemoveEntry(nodeID string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	delete(rt.bloomFilterMap, nodeID)
+}
+
+// UnionBloomFilters returns the union of the filters of every peer except
+// exclude at numHops hops from that peer.
+func (rt *RoutingTable) UnionBloomFilters(numHops int, exclude string) *BloomFilter {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	return rt.unionBloomFiltersLocked(numHops, exclude)
+}
+
+func (rt *RoutingTable) unionBloomFiltersLocked(numHops int, exclude string) *BloomFilter {
+	union := NewBF(rt.size, rt.numHashFuncs)
+	for nodeID, filters := range rt.bloomFilterMap {
+		if nodeID == exclude || numHops >= len(filters) {
+			continue
+		}
+		// Sizes are validated by UpdateEntry so this can't fail.
+		_ = union.Union(filters[numHops])
+	}
+	return union
+}
+
+// Filters returns the attenuated bloom filter this node advertises to the peer
+// with the specified ID. Filter 0 contains the local documents and filter i
+// contains the documents i hops away. The peer's own filters are left out so
+// it doesn't learn routes back through itself.
+func (rt *RoutingTable) Filters(exclude string) []*BloomFilter {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	filters := []*BloomFilter{rt.local.BloomFilter()}
+	for i := 1; i < rt.depth; i++ {
+		filters = append(filters, rt.unionBloomFiltersLocked(i-1, exclude))
+	}
+	return filters
+}
+
+// Route returns the peers that may have a document, ordered by the number of
+// hops to reach it.
+func (rt *RoutingTable) Route(id string) []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	hops := map[string]int{}
+	for nodeID, filters := range rt.bloomFilterMap {
+		for i, bf := range filters {
+			if bf.Check([]byte(id)) {
+				hops[nodeID] = i
+				break
+			}
+		}
+	}
+
+	var peers []string
+	for nodeID := range hops {
+		peers = append(peers, nodeID)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if hops[peers[i]] != hops[peers[j]] {
+			return hops[peers[i]] < hops[peers[j]]
+		}
+		return peers[i] < peers[j]
+	})
+	return peers
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoutingTableRoute(t *testing.T) {
+	rt := NewRT(3, 1024, 3)
+
+	near := NewBF(1024, 3)
+	near.Add([]byte("doc"))
+	far := NewBF(1024, 3)
+	far.Add([]byte("doc"))
+
+	if err := rt.UpdateEntry("b", []*BloomFilter{NewBF(1024, 3), far}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.UpdateEntry("a", []*BloomFilter{near}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.UpdateEntry("c", []*BloomFilter{NewBF(10, 3)}); err == nil {
+		t.Fatal("expected error for mismatched filter size")
+	}
+
+	if got, want := rt.Route("doc"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+	if got := rt.Route("missing"); len(got) != 0 {
+		t.Fatalf("expected no routes; got %+v", got)
+	}
+
+	rt.RemoveEntry("a")
+	if got, want := rt.Route("doc"), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestRoutingTableFilters(t *testing.T) {
+	rt := NewRT(3, 1024, 3)
+	rt.AddLocal("local")
+
+	a := NewBF(1024, 3)
+	a.Add([]byte("a"))
+	if err := rt.UpdateEntry("a", []*BloomFilter{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	filters := rt.Filters("b")
+	if len(filters) != 3 {
+		t.Fatalf("expected 3 filters; got %d", len(filters))
+	}
+	if !filters[0].Check([]byte("local")) {
+		t.Fatal("expected local document at hop 0")
+	}
+	if !filters[1].Check([]byte("a")) {
+		t.Fatal("expected peer document at hop 1")
+	}
+
+	if filters := rt.Filters("a"); filters[1].Check([]byte("a")) {
+		t.Fatal("expected peer's own filters to be excluded")
+	}
+}
+
+func TestRequestCache(t *testing.T) {
+	c := newRequestCache()
+	now := time.Now()
+	if !c.firstSeen("a", now) {
+		t.Fatal("expected first request to be handled")
+	}
+	if c.firstSeen("a", now.Add(time.Second)) {
+		t.Fatal("expected repeated request to be dropped")
+	}
+	if !c.firstSeen("", now) || !c.firstSeen("", now) {
+		t.Fatal("expected requests without an ID to always be handled")
+	}
+	if !c.firstSeen("a", now.Add(2*requestTTL)) {
+		t.Fatal("expected request to be handled again after it expired")
+	}
+}
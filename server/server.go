@@ -1,14 +1,17 @@
 package server
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/tls"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/fatih/color"
@@ -19,6 +22,9 @@ import (
 
 var ErrUnimplemented = errors.New("unimplemented")
 
+// ErrStopped is returned when the server is closed while storing documents.
+var ErrStopped = errors.New("server stopped")
+
 // Server is the main server struct.
 type Server struct {
 	log    *log.Logger
@@ -28,33 +34,124 @@ type Server struct {
 	key        *ecdsa.PrivateKey
 	cert       *tls.Certificate
 	certPublic string
+	id         string
+	rt         *RoutingTable
+	kb         *KBuckets // Kademlia routing table, used in DHT mode
+	requests   *requestCache
+	hashFunc   uint64 // multihash code used for new document IDs
+	codec      byte   // compression codec used for new documents
+
+	// gcMu is held for writing while garbage collecting and for reading while
+	// adding and pinning documents.
+	gcMu sync.RWMutex
+	// replicationMu serializes updates to replication records.
+	replicationMu sync.Mutex
+
+	evictC     chan struct{}
+	replicateC chan struct{}
+	announceC  chan struct{}
+	stopper    chan struct{}
 
 	mu struct {
 		sync.Mutex
 
 		l          net.Listener
 		grpcServer *grpc.Server
+		httpServer *http.Server
 		peerMeta   map[string]serverpb.NodeMeta
 		peers      map[string]serverpb.NodeClient
 		peerConns  map[string]*grpc.ClientConn
+		// references caches the references persisted in the store, keyed
+		// by reference ID.
 		references map[string]serverpb.Reference
+		// referenceRefreshes holds when each reference was last refreshed
+		// from the network, see findReference.
+		referenceRefreshes map[string]time.Time
+
+		storageUsed int64
+		documents   int64
+
+		// providers maps document IDs to the peers that announced storing
+		// them, keyed by node ID.
+		providers map[string]map[string]providerRecord
+		// providerRecords counts the records in providers by node ID.
+		providerRecords map[string]int
+		pendingAnnounce []string
+		// announcePeers holds the newly connected peers every local
+		// document is still to be announced to.
+		announcePeers []string
+
+		// dhtConns holds connections to nodes contacted during DHT lookups
+		// that aren't peers, at most maxDHTConns of them.
+		dhtConns map[string]*dhtConn
+		// dhtBootstrapping is set while the k-buckets are being populated.
+		dhtBootstrapping bool
+
+		// exchanges holds the open block exchange sessions. Sessions opened
+		// by this node are also indexed by peer in exchangePeers.
+		exchanges     map[*exchangeSession]struct{}
+		exchangePeers map[string]*exchangeSession
+		// wants maps the IDs of documents being fetched over block exchange
+		// to the fetches waiting for them.
+		wants map[string]*want
+
+		// adding counts the documents stored by adds whose root isn't
+		// pinned yet. Garbage collection and eviction keep them.
+		adding map[string]int
+
+		// accessed holds the document accesses not yet written to the
+		// store, see touchDocument.
+		accessed map[string]int64
 	}
 }
 
 // New returns a new server.
 func New(c serverpb.NodeConfig) (*Server, error) {
+	size, numHashFuncs, err := BloomFilterParams(expectedDocuments, falsePositiveRate)
+	if err != nil {
+		return nil, err
+	}
 	s := &Server{
-		log:    log.New(os.Stderr, "", log.Flags()|log.Lshortfile),
-		config: c,
+		log:      log.New(os.Stderr, "", log.Flags()|log.Lshortfile),
+		config:   c,
+		rt:       NewRT(routingDepth, size, numHashFuncs),
+		requests: newRequestCache(),
+
+		evictC:     make(chan struct{}, 1),
+		replicateC: make(chan struct{}, 1),
+		announceC:  make(chan struct{}, 1),
+		stopper:    make(chan struct{}),
 	}
 	s.mu.peerMeta = map[string]serverpb.NodeMeta{}
 	s.mu.peers = map[string]serverpb.NodeClient{}
 	s.mu.peerConns = map[string]*grpc.ClientConn{}
 	s.mu.references = map[string]serverpb.Reference{}
+	s.mu.referenceRefreshes = map[string]time.Time{}
+	s.mu.providers = map[string]map[string]providerRecord{}
+	s.mu.providerRecords = map[string]int{}
+	s.mu.dhtConns = map[string]*dhtConn{}
+	s.mu.exchanges = map[*exchangeSession]struct{}{}
+	s.mu.exchangePeers = map[string]*exchangeSession{}
+	s.mu.wants = map[string]*want{}
+	s.mu.adding = map[string]int{}
+	s.mu.accessed = map[string]int64{}
 
 	if len(c.Path) == 0 {
 		return nil, errors.Errorf("config: path must not be empty")
 	}
+	hashFunc, err := hashFuncCode(c.HashFunction)
+	if err != nil {
+		return nil, errors.Wrapf(err, "config")
+	}
+	s.hashFunc = hashFunc
+	codec, err := compressionCodec(c.Compression)
+	if err != nil {
+		return nil, errors.Wrapf(err, "config")
+	}
+	s.codec = codec
+	if err := validateRouting(c.Routing); err != nil {
+		return nil, errors.Wrapf(err, "config")
+	}
 	if err := os.MkdirAll(c.Path, 0700); err != nil {
 		return nil, err
 	}
@@ -74,17 +171,82 @@ func New(c serverpb.NodeConfig) (*Server, error) {
 		return nil, err
 	}
 
+	meta, err := s.NodeMeta()
+	if err != nil {
+		return nil, err
+	}
+	s.id = meta.Id
+	key, err := nodeKey(s.id)
+	if err != nil {
+		return nil, err
+	}
+	s.kb = NewKBuckets(key)
+
+	if err := s.loadRoutingTable(); err != nil {
+		return nil, err
+	}
+	if err := s.loadStorageUsage(); err != nil {
+		return nil, err
+	}
+	if err := s.loadReferences(); err != nil {
+		return nil, err
+	}
+	go s.evictLoop()
+	// Evict anything over the quota, in case it was lowered since the last
+	// run.
+	s.updateStorageUsage(0, 0)
+	go s.replicateLoop()
+	go s.announceLoop()
+
 	return s, nil
 }
 
+// stopped returns whether the server was closed. Background work that uses
+// the store checks it while holding gcMu.
+func (s *Server) stopped() bool {
+	select {
+	case <-s.stopper:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopContext returns a context that is canceled when the server is closed.
+func (s *Server) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-s.stopper:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
 func (s *Server) Close() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if s.mu.grpcServer != nil {
 		s.mu.grpcServer.Stop()
 	}
+	if s.mu.httpServer != nil {
+		if err := s.mu.httpServer.Close(); err != nil {
+			s.log.Printf("failed to close http server: %+v", err)
+		}
+	}
+	s.mu.Unlock()
+
+	close(s.stopper)
+	// Lookups see the server is stopped and don't cache new connections
+	// once these are closed.
+	s.closeDHTConns()
+	// Wait for any running eviction or garbage collection to finish before
+	// closing the store.
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
 
+	s.flushAccesses()
 	if err := s.db.Close(); err != nil {
 		return errors.Wrapf(err, "db close")
 	}
@@ -110,14 +272,45 @@ func (s *Server) Listen(addr string) error {
 
 	meta, err := s.NodeMeta()
 	if err != nil {
+		l.Close()
 		return err
 	}
 
 	s.log.SetPrefix(color.RedString(meta.Id) + " " + color.GreenString(l.Addr().String()) + " ")
 
 	s.log.Printf("Listening to %s", l.Addr().String())
+	if s.config.HttpAddr != "" {
+		if err := s.listenHTTP(s.config.HttpAddr); err != nil {
+			// grpcServer only closes listeners it is serving.
+			l.Close()
+			return err
+		}
+	}
 	if err := grpcServer.Serve(l); err != nil && err != grpc.ErrServerStopped {
 		return err
 	}
 	return nil
 }
+
+// listenHTTP starts the HTTP gateway on the specified address.
+func (s *Server) listenHTTP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{
+		Handler: s.gatewayHandler(),
+	}
+
+	s.mu.Lock()
+	s.mu.httpServer = httpServer
+	s.mu.Unlock()
+
+	s.log.Printf("HTTP gateway listening to %s", l.Addr().String())
+	go func() {
+		if err := httpServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.log.Printf("http server error: %+v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+func documentStatKey(id string) []byte {
+	return []byte(fmt.Sprintf("/documentstat/%s", id))
+}
+
+func getDocumentStat(txn *badger.Txn, id string) (serverpb.DocumentStat, error) {
+	var stat serverpb.DocumentStat
+	item, err := txn.Get(documentStatKey(id))
+	if err != nil {
+		return stat, err
+	}
+	body, err := item.Value()
+	if err != nil {
+		return stat, err
+	}
+	if err := stat.Unmarshal(body); err != nil {
+		return stat, err
+	}
+	return stat, nil
+}
+
+func setDocumentStat(txn *badger.Txn, id string, stat serverpb.DocumentStat) error {
+	body, err := stat.Marshal()
+	if err != nil {
+		return err
+	}
+	return txn.Set(documentStatKey(id), body)
+}
+
+// loadStorageUsage computes the storage used by the local documents. Documents
+// stored before stats were tracked get a stat with the current time.
+func (s *Server) loadStorageUsage() error {
+	ids, err := s.localDocumentIDs()
+	if err != nil {
+		return err
+	}
+	var used, documents int64
+	for _, id := range ids {
+		if err := s.db.Update(func(txn *badger.Txn) error {
+			stat, err := getDocumentStat(txn, id)
+			if err == badger.ErrKeyNotFound {
+				item, err := txn.Get(documentKey(id))
+				if err != nil {
+					return err
+				}
+				body, err := item.Value()
+				if err != nil {
+					return err
+				}
+				stat = serverpb.DocumentStat{
+					Length:     int64(len(body)),
+					LastAccess: time.Now().UnixNano(),
+				}
+				if err := setDocumentStat(txn, id, stat); err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+			used += stat.Length
+			documents++
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mu.storageUsed = used
+	s.mu.documents = documents
+	return nil
+}
+
+// updateStorageUsage adjusts the storage accounting after a document was
+// stored or deleted and schedules an eviction if the quota is exceeded.
+func (s *Server) updateStorageUsage(delta, documents int64) {
+	s.mu.Lock()
+	s.mu.storageUsed += delta
+	s.mu.documents += documents
+	over := s.config.MaxStorage > 0 && s.mu.storageUsed > s.config.MaxStorage
+	s.mu.Unlock()
+
+	if over {
+		select {
+		case s.evictC <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// accessFlushInterval is how often recorded document accesses are written to
+// the store.
+const accessFlushInterval = time.Minute
+
+// touchDocument records that a document was accessed. Accesses are batched in
+// memory and written by flushAccesses so reads don't write to the store.
+func (s *Server) touchDocument(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.accessed[id] = time.Now().UnixNano()
+}
+
+// flushAccesses writes the recorded document accesses to the store. Accesses
+// that conflict with another write are kept for the next flush. The caller
+// must hold gcMu.
+func (s *Server) flushAccesses() {
+	s.mu.Lock()
+	accessed := s.mu.accessed
+	s.mu.accessed = map[string]int64{}
+	s.mu.Unlock()
+
+	for id, lastAccess := range accessed {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			stat, err := getDocumentStat(txn, id)
+			if err == badger.ErrKeyNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if stat.LastAccess >= lastAccess {
+				return nil
+			}
+			stat.LastAccess = lastAccess
+			return setDocumentStat(txn, id, stat)
+		})
+		if err == badger.ErrConflict {
+			s.mu.Lock()
+			if s.mu.accessed[id] < lastAccess {
+				s.mu.accessed[id] = lastAccess
+			}
+			s.mu.Unlock()
+		} else if err != nil {
+			s.log.Printf("failed to record access to %s: %+v", id, err)
+		}
+	}
+}
+
+// evictLoop evicts documents whenever the storage quota is exceeded and
+// periodically writes the recorded document accesses.
+func (s *Server) evictLoop() {
+	ticker := time.NewTicker(accessFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopper:
+			return
+		case <-ticker.C:
+			s.gcMu.RLock()
+			if !s.stopped() {
+				s.flushAccesses()
+			}
+			s.gcMu.RUnlock()
+		case <-s.evictC:
+			if err := s.evict(); err != nil {
+				s.log.Printf("eviction error: %+v", err)
+			}
+		}
+	}
+}
+
+// evict deletes the least recently used documents that aren't reachable from
+// a pin until the storage used is within the quota.
+func (s *Server) evict() error {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	if s.stopped() {
+		return nil
+	}
+	s.flushAccesses()
+
+	marked, err := s.markPinned()
+	if err != nil {
+		return err
+	}
+	ids, err := s.localDocumentIDs()
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		id   string
+		stat serverpb.DocumentStat
+	}
+	var candidates []candidate
+	if err := s.db.View(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			if marked[id] {
+				continue
+			}
+			stat, err := getDocumentStat(txn, id)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, candidate{id: id, stat: stat})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].stat.LastAccess < candidates[j].stat.LastAccess
+	})
+
+	for _, c := range candidates {
+		s.mu.Lock()
+		over := s.mu.storageUsed > s.config.MaxStorage
+		s.mu.Unlock()
+		if !over {
+			return nil
+		}
+		if err := s.deleteDocument(c.id); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mu.storageUsed > s.config.MaxStorage {
+		s.log.Printf("pinned documents use %d bytes; exceeding the storage limit of %d bytes", s.mu.storageUsed, s.config.MaxStorage)
+	}
+	return nil
+}
+
+func (s *Server) StorageUsage(ctx context.Context, in *serverpb.StorageUsageRequest) (*serverpb.StorageUsageResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &serverpb.StorageUsageResponse{
+		Used:      s.mu.storageUsed,
+		Max:       s.config.MaxStorage,
+		Documents: s.mu.documents,
+	}, nil
+}
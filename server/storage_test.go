@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/util"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+)
+
+func TestStorageEviction(t *testing.T) {
+	s, stop := newTestServer(t, func(c *serverpb.NodeConfig) {
+		c.MaxStorage = 4000
+	})
+	defer stop()
+
+	ctx := context.Background()
+
+	pinned, err := s.Add(ctx, &serverpb.AddRequest{
+		Document: &serverpb.Document{Data: make([]byte, 1000)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache documents without pinning them, as if fetched from a peer.
+	var cached []string
+	for i := 0; i < 3; i++ {
+		id, err := s.storeDocument(serverpb.Document{Data: make([]byte, 900+i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached = append(cached, id)
+	}
+	// Accessing the oldest document makes the second one least recently used.
+	if _, err := s.getDocument(ctx, cached[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.storeDocument(serverpb.Document{Data: make([]byte, 500)}); err != nil {
+		t.Fatal(err)
+	}
+
+	util.SucceedsSoon(t, func() error {
+		resp, err := s.StorageUsage(ctx, &serverpb.StorageUsageRequest{})
+		if err != nil {
+			return err
+		}
+		if resp.Used > resp.Max {
+			return errors.Errorf("expected usage under %d; got %d", resp.Max, resp.Used)
+		}
+		return nil
+	})
+
+	if _, err := s.localDocument(cached[1]); err != badger.ErrKeyNotFound {
+		t.Fatalf("expected least recently used document to be evicted; got %v", err)
+	}
+	for _, id := range []string{pinned.DocumentId, cached[0], cached[2]} {
+		if _, err := s.localDocument(id); err != nil {
+			t.Fatalf("expected %s to be kept; got %v", id, err)
+		}
+	}
+}
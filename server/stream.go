@@ -0,0 +1,141 @@
+package server
+
+import (
+	"io"
+	"proj2_f5w9a_h6v9a_q7w9a_r8u8_w1c0b/serverpb"
+)
+
+// streamReader reads the data sent by a client over a client streaming call.
+type streamReader struct {
+	recv func() ([]byte, error)
+	buf  []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		data, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (s *Server) AddStream(stream serverpb.Client_AddStreamServer) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		req = &serverpb.AddStreamRequest{}
+	} else if err != nil {
+		return err
+	}
+
+	doc := serverpb.Document{
+		ContentType: req.ContentType,
+	}
+	key, err := addKey(req.Encrypt, doc)
+	if err != nil {
+		return err
+	}
+
+	r := &streamReader{
+		recv: func() ([]byte, error) {
+			req, err := stream.Recv()
+			if err != nil {
+				return nil, err
+			}
+			return req.Data, nil
+		},
+		buf: req.Data,
+	}
+	id, release, err := s.addFile(doc, r, req.Chunker, key)
+	if err != nil {
+		return err
+	}
+	if req.NoPin {
+		s.leaseAdded(release)
+	} else {
+		defer release()
+		if err := s.pinAdded(id, req.ReplicationFactor); err != nil {
+			return err
+		}
+	}
+
+	resp := &serverpb.AddResponse{
+		DocumentId: id,
+	}
+	if key != nil {
+		resp.Capability = formatCapability(id, key)
+	}
+	return stream.SendAndClose(resp)
+}
+
+func (s *Server) GetStream(in *serverpb.GetRequest, stream serverpb.Client_GetStreamServer) error {
+	ctx := stream.Context()
+	id, doc, key, err := s.resolvePath(ctx, in.DocumentId)
+	if err != nil {
+		return err
+	}
+
+	meta := doc
+	meta.Data = nil
+	meta.Blocks = nil
+	if err := stream.Send(&serverpb.GetStreamResponse{
+		Document:   &meta,
+		DocumentId: id,
+	}); err != nil {
+		return err
+	}
+
+	// Blocks are downloaded from every peer holding them while the data is
+	// sent, reporting progress as they arrive.
+	blocks := s.newDownloader(ctx, rangeBlocks(doc, in.Offset, in.Length), key, func(p serverpb.DownloadProgress) error {
+		return stream.Send(&serverpb.GetStreamResponse{Progress: &p})
+	})
+	defer blocks.close()
+	r, err := s.readRange(ctx, doc, key, in.Offset, in.Length, blocks)
+	if err != nil {
+		return err
+	}
+	// Reads return at most the rest of the current block so the data is sent
+	// one block at a time.
+	buf := make([]byte, blockSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&serverpb.GetStreamResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// streamWriter sends the data written to it to a client over a server
+// streaming call, in messages of at most max bytes.
+type streamWriter struct {
+	send func([]byte) error
+	max  int
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.max {
+			n = w.max
+		}
+		if err := w.send(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}